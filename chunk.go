@@ -0,0 +1,122 @@
+package deslang
+
+type opcode byte
+
+// Instructions understood by the VM. Operands follow the opcode in the code.
+// Constant indexes, jump offsets and counts of list items or map entries are
+// two bytes, big-endian. Local slots, upvalue indexes and argument counts are
+// one byte.
+const (
+	opConstant     opcode = iota // constant
+	opNil                        //
+	opTrue                       //
+	opFalse                      //
+	opPop                        //
+	opGetLocal                   // slot
+	opSetLocal                   // slot
+	opGetGlobal                  // name constant
+	opDefineGlobal               // name constant
+	opSetGlobal                  // name constant
+	opGetUpvalue                 // upvalue index
+	opSetUpvalue                 // upvalue index
+	opGetProperty                // name constant
+	opSetProperty                // name constant
+	opGetSuper                   // name constant
+	opEqual                      //
+	opNotEqual                   //
+	opGreater                    //
+	opGreaterEqual               //
+	opLess                       //
+	opLessEqual                  //
+	opAdd                        //
+	opSubtract                   //
+	opMultiply                   //
+	opDivide                     //
+	opNot                        //
+	opNegate                     //
+	opPrint                      //
+	opJump                       // forward offset
+	opJumpIfFalse                // forward offset
+	opLoop                       // backward offset
+	opCall                       // argument count
+	opClosure                    // function constant, then a pair of bytes per upvalue
+	opCloseUpvalue               //
+	opReturn                     //
+	opClass                      // name constant
+	opInherit                    //
+	opMethod                     // name constant
+	opList                       // item count
+	opMap                        //
+	opMapEntry                   //
+	opIndexGet                   //
+	opIndexSet                   //
+	opForIter                    // iterable slot, variable count, forward offset
+	opEcho                       //
+)
+
+// Operator each arithmetic or comparison instruction performs, for passing to
+// unaryOp and binaryOp.
+var opTokens = map[opcode]tokentype{
+	opEqual:        _equal_equal,
+	opNotEqual:     _bang_equal,
+	opGreater:      _greater,
+	opGreaterEqual: _greater_equal,
+	opLess:         _less,
+	opLessEqual:    _less_equal,
+	opAdd:          _plus,
+	opSubtract:     _minus,
+	opMultiply:     _star,
+	opDivide:       _slash,
+	opNot:          _bang,
+	opNegate:       _minus,
+}
+
+// A sequence of bytecode along with the constants it refers to. Spans holds the
+// position in the source of every byte in Code, for reporting runtime errors.
+type Chunk struct {
+	Code      []byte
+	Constants []Value
+	Spans     []Span
+}
+
+func (c *Chunk) write(b byte, pos Span) {
+	c.Code = append(c.Code, b)
+	c.Spans = append(c.Spans, pos)
+}
+
+// Add a value to the constants table and return its index. Numbers and strings
+// that are already in the table are reused.
+func (c *Chunk) addConstant(v Value) int {
+	if v.Kind == floatLit || v.Kind == stringLit {
+		for i, constant := range c.Constants {
+			if constant.Kind == v.Kind && isEqual(constant, v) {
+				return i
+			}
+		}
+	}
+
+	c.Constants = append(c.Constants, v)
+	return len(c.Constants) - 1
+}
+
+// Read a two byte operand starting at offset.
+func (c *Chunk) readShort(offset int) int {
+	return int(c.Code[offset])<<8 | int(c.Code[offset+1])
+}
+
+// A compiled function. Protos are stored in the constants table of the chunk
+// that declares them and turned into closures at runtime.
+type funcProto struct {
+	name         string // empty for the top-level script
+	arity        int
+	upvalueCount int
+	maxStack     int // most stack slots a call uses, counting from slot 0
+	chunk        Chunk
+}
+
+func (fn *funcProto) String() string {
+	if fn.name == "" {
+		return "<script>"
+	}
+	return "<fn " + fn.name + ">"
+}
@@ -0,0 +1,73 @@
+package deslang
+
+// Declared with 'class'. Calling a class creates a new instance of it.
+type class struct {
+	name       string
+	superclass *class // nil if the class doesn't inherit
+	methods    map[string]*function
+}
+
+// Methods not found on the class are looked up on the superclass.
+func (c *class) findMethod(name string) (*function, bool) {
+	if method, has := c.methods[name]; has {
+		return method, true
+	}
+
+	if c.superclass != nil {
+		return c.superclass.findMethod(name)
+	}
+
+	return nil, false
+}
+
+// Same as the arity of the initializer, or 0 if there isn't one.
+func (c *class) Arity() int {
+	if init, has := c.findMethod("init"); has {
+		return init.Arity()
+	}
+	return 0
+}
+
+func (c *class) Call(env *Environment, args []Value) (Value, error) {
+	inst := &instance{class: c, fields: make(map[string]Value)}
+
+	if init, has := c.findMethod("init"); has {
+		if _, err := init.bind(inst).Call(env, args); err != nil {
+			return Nil, err
+		}
+	}
+
+	return instanceValue(inst), nil
+}
+
+func (c *class) String() string {
+	return c.name
+}
+
+type instance struct {
+	class  *class
+	fields map[string]Value
+}
+
+// Fields shadow methods with the same name.
+func (inst *instance) get(name Token) (Value, error) {
+	s := name.name()
+
+	if val, has := inst.fields[s]; has {
+		return val, nil
+	}
+
+	if method, has := inst.class.findMethod(s); has {
+		return funcValue(method.bind(inst)), nil
+	}
+
+	return Nil, lineError(name, "Undefined property '%s'.", s)
+}
+
+func (inst *instance) set(name Token, val Value) {
+	inst.fields[name.name()] = val
+}
+
+func (inst *instance) String() string {
+	return inst.class.name + " instance"
+}
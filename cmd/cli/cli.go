@@ -1,24 +1,49 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
+	"flag"
 	"fmt"
 	"github.com/despreston/deslang"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
 func main() {
-	arglen := len(os.Args)
+	if len(os.Args) > 1 && os.Args[1] == "compile" {
+		if err := compileFile(os.Args[2:]); err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	var disasm bool
+
+	flag.BoolVar(&disasm, "disasm", false, "Print the compiled bytecode of the script instead of running it")
+	flag.Usage = func() {
+		fmt.Println("Usage: deslang [--disasm] [script]")
+		fmt.Println("       deslang compile script [-o output]")
+	}
+	flag.Parse()
+
+	arglen := flag.NArg()
 	var err error
 
 	switch {
-	case arglen > 2:
-		fmt.Println("Usage: deslang [script]")
+	case arglen > 1:
+		flag.Usage()
+		os.Exit(64)
+	case disasm && arglen == 0:
+		fmt.Println("--disasm requires a script.")
 		os.Exit(64)
-	case arglen == 2:
-		err = runFile(os.Args[1])
+	case disasm:
+		err = disasmFile(flag.Arg(0))
+	case arglen == 1:
+		err = runFile(flag.Arg(0))
 	default:
 		err = runPrompt()
 	}
@@ -36,25 +61,117 @@ func runFile(path string) error {
 	}
 
 	defer f.Close()
-	return deslang.NewInterpreter(os.Stdout).Run(f)
+
+	interpreter := deslang.NewInterpreter(os.Stdout)
+	if filepath.Ext(path) == ".dlc" {
+		return interpreter.RunCompiled(f)
+	}
+	return interpreter.Run(f)
+}
+
+// Compile a script to a .dlc file. The output defaults to the script's path
+// with its extension replaced by .dlc.
+func compileFile(args []string) error {
+	var out string
+
+	flags := flag.NewFlagSet("compile", flag.ExitOnError)
+	flags.StringVar(&out, "o", "", "Write the compiled program to this file")
+	flags.Usage = func() {
+		fmt.Println("Usage: deslang compile script [-o output]")
+	}
+
+	// Allow -o on either side of the script.
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(64)
+	}
+	path := flags.Arg(0)
+	flags.Parse(flags.Args()[1:])
+	if flags.NArg() > 0 {
+		flags.Usage()
+		os.Exit(64)
+	}
+
+	if out == "" {
+		out = strings.TrimSuffix(path, filepath.Ext(path)) + ".dlc"
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Compile into memory first so a script with errors doesn't leave behind a
+	// broken output file.
+	var buf bytes.Buffer
+	err = deslang.NewInterpreter(os.Stdout).Compile(f, &buf)
+	if err == deslang.ErrCompile {
+		os.Exit(65)
+	}
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(out, buf.Bytes(), 0644)
+}
+
+func disasmFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+	return deslang.NewInterpreter(os.Stdout).Disassemble(f)
 }
 
-// Reads stdin until the first '\n' then calls 'run' with the input.
+// Reads stdin a line at a time and runs each statement once it's complete. While
+// a statement is unfinished, e.g. a block missing its closing brace, the
+// continuation prompt is shown and more lines are read. An empty line runs what
+// has been entered so far regardless, so a mistake can't leave the prompt stuck.
+// Ctrl-C throws away what has been entered.
+//
+// On a terminal, lines are read with the lineEditor, which completes keywords
+// and global variables. History is saved to $DESLANG_HISTORY if it's set.
 func runPrompt() error {
-	reader := bufio.NewReader(os.Stdin)
 	interpreter := deslang.NewInterpreter(os.Stdout)
+	interpreter.SetREPL(true)
+	editor := newLineEditor(os.Stdin, os.Stdout, interpreter.Completions)
+
+	var input []byte
 
 	for {
-		fmt.Print("deslang> ")
+		prompt := "deslang> "
+		if len(input) > 0 {
+			prompt = "...> "
+		}
 
-		line, err := reader.ReadBytes('\n')
-		if err != nil {
-			if err == io.EOF {
-				return nil
-			}
+		line, err := editor.readLine(prompt)
+		if err == errInterrupt {
+			input = input[:0]
+			continue
+		}
+		if err != nil && err != io.EOF {
 			return err
 		}
 
-		interpreter.Run(bytes.NewReader(line))
+		input = append(input, line...)
+		input = append(input, '\n')
+
+		if err == nil && strings.TrimSpace(line) != "" &&
+			interpreter.Incomplete(bytes.NewReader(input)) {
+			continue
+		}
+
+		if len(bytes.TrimSpace(input)) > 0 {
+			interpreter.Run(bytes.NewReader(input))
+		}
+		input = input[:0]
+
+		if err == io.EOF {
+			return nil
+		}
 	}
 }
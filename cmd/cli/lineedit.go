@@ -0,0 +1,490 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// Most lines of history kept, in memory and in the history file.
+const maxHistory = 1000
+
+// Returned by readLine when Ctrl-C is pressed.
+var errInterrupt = errors.New("interrupted")
+
+// Keys that don't stand for a character are given negative runes by readKey.
+const (
+	keyUp rune = -(iota + 1)
+	keyDown
+	keyLeft
+	keyRight
+	keyHome
+	keyEnd
+	keyDelete
+	keyUnknown
+)
+
+// Control characters.
+const (
+	ctrlA     = 1
+	ctrlB     = 2
+	ctrlC     = 3
+	ctrlD     = 4
+	ctrlE     = 5
+	ctrlF     = 6
+	ctrlG     = 7
+	ctrlH     = 8
+	tab       = 9
+	lineFeed  = 10
+	ctrlK     = 11
+	ctrlL     = 12
+	enter     = 13
+	ctrlN     = 14
+	ctrlP     = 16
+	ctrlR     = 18
+	ctrlU     = 21
+	ctrlW     = 23
+	escape    = 27
+	backspace = 127
+)
+
+// Reads lines from a terminal, letting them be edited as they're typed. Arrow
+// keys and the usual Emacs-style control keys move the cursor, up and down step
+// through history, Ctrl-R searches history and Tab completes the word before the
+// cursor. When the input isn't a terminal, lines are read as they are.
+type lineEditor struct {
+	in       *bufio.Reader
+	out      io.Writer
+	fd       int
+	complete func(prefix string) []string
+	history  []string
+	histPath string // file history is saved to, empty if it isn't saved
+
+	// The line being edited.
+	prompt string
+	buf    []rune
+	pos    int // cursor position in buf
+}
+
+// Create a lineEditor reading from in. complete returns the words that the word
+// being typed could be completed to.
+func newLineEditor(in *os.File, out io.Writer, complete func(prefix string) []string) *lineEditor {
+	e := &lineEditor{
+		in:       bufio.NewReader(in),
+		out:      out,
+		fd:       int(in.Fd()),
+		complete: complete,
+	}
+	e.loadHistory()
+	return e
+}
+
+// The history file is $DESLANG_HISTORY. Saving history is opt-in since the same
+// user may be running many REPLs, e.g. one per SSH session, which would all see
+// each other's lines in a shared file. Without it history lasts only as long as
+// the process.
+func historyPath() string {
+	return os.Getenv("DESLANG_HISTORY")
+}
+
+// Read the history file, one entry per line. If it's grown too long, only the
+// most recent entries are kept and the file is rewritten with them.
+func (e *lineEditor) loadHistory() {
+	e.histPath = historyPath()
+	if e.histPath == "" {
+		return
+	}
+
+	data, err := ioutil.ReadFile(e.histPath)
+	if err != nil {
+		return
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if line != "" {
+			e.history = append(e.history, line)
+		}
+	}
+
+	if len(e.history) > maxHistory {
+		e.history = e.history[len(e.history)-maxHistory:]
+		ioutil.WriteFile(e.histPath, []byte(strings.Join(e.history, "\n")+"\n"), 0600)
+	}
+}
+
+// Add line to the history and append it to the history file. Blank lines and
+// repeats of the previous entry are skipped.
+func (e *lineEditor) addHistory(line string) {
+	if strings.TrimSpace(line) == "" {
+		return
+	}
+	if n := len(e.history); n > 0 && e.history[n-1] == line {
+		return
+	}
+
+	e.history = append(e.history, line)
+	if len(e.history) > maxHistory {
+		e.history = e.history[1:]
+	}
+
+	if e.histPath == "" {
+		return
+	}
+
+	f, err := os.OpenFile(e.histPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fmt.Fprintln(f, line)
+}
+
+// Show prompt and read a line, without the line break. Returns io.EOF at the end
+// of the input, possibly along with a final unterminated line, and errInterrupt
+// if Ctrl-C is pressed.
+func (e *lineEditor) readLine(prompt string) (string, error) {
+	restore, err := makeRaw(e.fd)
+	if err != nil {
+		fmt.Fprint(e.out, prompt)
+		line, err := e.in.ReadString('\n')
+		return strings.TrimSuffix(line, "\n"), err
+	}
+	defer restore()
+
+	e.prompt = prompt
+	e.buf = e.buf[:0]
+	e.pos = 0
+	e.refresh()
+
+	histIdx := len(e.history)
+	var saved []rune // line being typed before stepping into history
+
+	for {
+		r, err := e.readKey()
+		if err != nil {
+			return "", err
+		}
+
+		if r == ctrlR {
+			if r, err = e.search(); err != nil {
+				return "", err
+			}
+		}
+
+		switch r {
+		case enter, lineFeed:
+			line := string(e.buf)
+			fmt.Fprint(e.out, "\r\n")
+			e.addHistory(line)
+			return line, nil
+
+		case ctrlC:
+			fmt.Fprint(e.out, "^C\r\n")
+			return "", errInterrupt
+
+		case ctrlD:
+			if len(e.buf) == 0 {
+				fmt.Fprint(e.out, "\r\n")
+				return "", io.EOF
+			}
+			e.delete(e.pos, e.pos+1)
+
+		case keyDelete:
+			e.delete(e.pos, e.pos+1)
+
+		case backspace, ctrlH:
+			if e.pos > 0 {
+				e.delete(e.pos-1, e.pos)
+			}
+
+		case ctrlW:
+			start := e.pos
+			for start > 0 && unicode.IsSpace(e.buf[start-1]) {
+				start--
+			}
+			for start > 0 && !unicode.IsSpace(e.buf[start-1]) {
+				start--
+			}
+			e.delete(start, e.pos)
+
+		case ctrlU:
+			e.delete(0, e.pos)
+
+		case ctrlK:
+			e.delete(e.pos, len(e.buf))
+
+		case ctrlA, keyHome:
+			e.pos = 0
+
+		case ctrlE, keyEnd:
+			e.pos = len(e.buf)
+
+		case ctrlB, keyLeft:
+			if e.pos > 0 {
+				e.pos--
+			}
+
+		case ctrlF, keyRight:
+			if e.pos < len(e.buf) {
+				e.pos++
+			}
+
+		case ctrlP, keyUp:
+			if histIdx == 0 {
+				break
+			}
+			if histIdx == len(e.history) {
+				saved = append(saved[:0], e.buf...)
+			}
+			histIdx--
+			e.setLine([]rune(e.history[histIdx]))
+
+		case ctrlN, keyDown:
+			if histIdx == len(e.history) {
+				break
+			}
+			histIdx++
+			if histIdx == len(e.history) {
+				e.setLine(saved)
+			} else {
+				e.setLine([]rune(e.history[histIdx]))
+			}
+
+		case ctrlL:
+			fmt.Fprint(e.out, "\x1b[H\x1b[2J")
+
+		case tab:
+			e.completeWord()
+
+		default:
+			if r >= 0 && unicode.IsPrint(r) {
+				e.buf = append(e.buf, 0)
+				copy(e.buf[e.pos+1:], e.buf[e.pos:])
+				e.buf[e.pos] = r
+				e.pos++
+			}
+		}
+
+		e.refresh()
+	}
+}
+
+// Read a key press. Escape sequences for arrow and editing keys are turned into
+// the key constants; ones that aren't understood are keyUnknown.
+func (e *lineEditor) readKey() (rune, error) {
+	r, _, err := e.in.ReadRune()
+	if err != nil || r != escape {
+		return r, err
+	}
+
+	// CSI sequences are ESC [ then parameters then a final byte from '@' to '~'.
+	// Some terminals send ESC O and a letter for the same keys.
+	intro, _, err := e.in.ReadRune()
+	if err != nil {
+		return 0, err
+	}
+	if intro != '[' && intro != 'O' {
+		// A lone ESC, or Alt with a key; keep the key for the next read.
+		e.in.UnreadRune()
+		return keyUnknown, nil
+	}
+
+	var params []rune
+	for {
+		c, _, err := e.in.ReadRune()
+		if err != nil {
+			return 0, err
+		}
+		if c >= '@' && c <= '~' {
+			return escapeKey(string(params), c), nil
+		}
+		params = append(params, c)
+	}
+}
+
+func escapeKey(params string, final rune) rune {
+	switch final {
+	case 'A':
+		return keyUp
+	case 'B':
+		return keyDown
+	case 'C':
+		return keyRight
+	case 'D':
+		return keyLeft
+	case 'H':
+		return keyHome
+	case 'F':
+		return keyEnd
+	case '~':
+		switch params {
+		case "1", "7":
+			return keyHome
+		case "4", "8":
+			return keyEnd
+		case "3":
+			return keyDelete
+		}
+	}
+	return keyUnknown
+}
+
+// Remove buf[from:to] and leave the cursor at from.
+func (e *lineEditor) delete(from, to int) {
+	if to > len(e.buf) {
+		to = len(e.buf)
+	}
+	if from >= to {
+		return
+	}
+	e.buf = append(e.buf[:from], e.buf[to:]...)
+	e.pos = from
+}
+
+// Replace the line with a copy of line and put the cursor at the end.
+func (e *lineEditor) setLine(line []rune) {
+	e.buf = append(e.buf[:0], line...)
+	e.pos = len(e.buf)
+}
+
+// Redraw the prompt and line and put the cursor back in place.
+func (e *lineEditor) refresh() {
+	var b strings.Builder
+	b.WriteString("\r")
+	b.WriteString(e.prompt)
+	b.WriteString(string(e.buf))
+	b.WriteString("\x1b[K")
+	if back := len(e.buf) - e.pos; back > 0 {
+		fmt.Fprintf(&b, "\x1b[%dD", back)
+	}
+	io.WriteString(e.out, b.String())
+}
+
+// Complete the word before the cursor. If it has only one completion the rest
+// of it is inserted. Otherwise as much as the completions have in common is
+// inserted, and if that's nothing they're listed below the line.
+func (e *lineEditor) completeWord() {
+	start := e.pos
+	for start > 0 && isWordRune(e.buf[start-1]) {
+		start--
+	}
+	if start == e.pos {
+		return
+	}
+
+	prefix := string(e.buf[start:e.pos])
+	names := e.complete(prefix)
+
+	switch len(names) {
+	case 0:
+		fmt.Fprint(e.out, "\a")
+		return
+	case 1:
+		e.insert(names[0][len(prefix):])
+		return
+	}
+
+	common := []rune(names[0])
+	for _, name := range names[1:] {
+		for !strings.HasPrefix(name, string(common)) {
+			common = common[:len(common)-1]
+		}
+	}
+
+	if len(common) > e.pos-start {
+		e.insert(string(common[e.pos-start:]))
+		return
+	}
+
+	fmt.Fprintf(e.out, "\r\n%s\r\n", strings.Join(names, "  "))
+}
+
+// The same characters the Scanner allows in identifiers.
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsNumber(r)
+}
+
+// Insert s at the cursor and move the cursor past it.
+func (e *lineEditor) insert(s string) {
+	ins := []rune(s)
+	e.buf = append(e.buf[:e.pos], append(ins, e.buf[e.pos:]...)...)
+	e.pos += len(ins)
+}
+
+// Search history backwards for entries containing what's typed, starting from
+// the most recent. Ctrl-R again finds the next older match. Ctrl-C or Ctrl-G
+// cancels the search and puts back the line as it was. Any other key that isn't
+// part of the search accepts the match into the line and is returned for
+// readLine to handle as usual.
+func (e *lineEditor) search() (rune, error) {
+	orig := append([]rune(nil), e.buf...)
+	origPos := e.pos
+
+	var query []rune
+	match := len(e.history) // index of the matching entry, len(history) if none
+	failed := false
+
+	// Find the newest entry at or before from containing the query.
+	find := func(from int) {
+		for i := from; i >= 0; i-- {
+			if strings.Contains(e.history[i], string(query)) {
+				match = i
+				failed = false
+				e.setLine([]rune(e.history[i]))
+				return
+			}
+		}
+		failed = true
+	}
+
+	for {
+		label := "reverse-i-search"
+		if failed {
+			label = "failing " + label
+		}
+		line := ""
+		if match < len(e.history) {
+			line = e.history[match]
+		}
+		fmt.Fprintf(e.out, "\r(%s)`%s': %s\x1b[K", label, string(query), line)
+
+		r, err := e.readKey()
+		if err != nil {
+			return 0, err
+		}
+
+		switch {
+		case r == ctrlR:
+			if len(query) > 0 && match > 0 {
+				find(match - 1)
+			}
+
+		case r == backspace || r == ctrlH:
+			if len(query) > 0 {
+				query = query[:len(query)-1]
+				find(len(e.history) - 1)
+			}
+
+		case r == ctrlC || r == ctrlG:
+			e.buf = append(e.buf[:0], orig...)
+			e.pos = origPos
+			return keyUnknown, nil
+
+		case r >= 0 && unicode.IsPrint(r):
+			query = append(query, r)
+			from := match
+			if from == len(e.history) {
+				from--
+			}
+			find(from)
+
+		default:
+			return r, nil
+		}
+	}
+}
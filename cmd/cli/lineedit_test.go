@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// A lineEditor reading input and writing to a buffer. Its fd isn't a terminal,
+// so readLine falls back to reading whole lines.
+func testEditor(input string, words ...string) (*lineEditor, *bytes.Buffer) {
+	var out bytes.Buffer
+	e := &lineEditor{
+		in:  bufio.NewReader(strings.NewReader(input)),
+		out: &out,
+		fd:  -1,
+		complete: func(prefix string) []string {
+			var names []string
+			for _, w := range words {
+				if strings.HasPrefix(w, prefix) {
+					names = append(names, w)
+				}
+			}
+			return names
+		},
+	}
+	return e, &out
+}
+
+func TestEscapeKey(t *testing.T) {
+	tests := []struct {
+		params string
+		final  rune
+		want   rune
+	}{
+		{"", 'A', keyUp},
+		{"", 'B', keyDown},
+		{"", 'C', keyRight},
+		{"", 'D', keyLeft},
+		{"", 'H', keyHome},
+		{"", 'F', keyEnd},
+		{"1", '~', keyHome},
+		{"7", '~', keyHome},
+		{"4", '~', keyEnd},
+		{"8", '~', keyEnd},
+		{"3", '~', keyDelete},
+		{"5", '~', keyUnknown},
+		{"1;5", 'Z', keyUnknown},
+	}
+
+	for _, tt := range tests {
+		if got := escapeKey(tt.params, tt.final); got != tt.want {
+			t.Errorf("escapeKey(%q, %q) = %d, want %d", tt.params, tt.final, got, tt.want)
+		}
+	}
+}
+
+func TestReadKey(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []rune
+	}{
+		{"characters", "aé", []rune{'a', 'é'}},
+		{"csi", "\x1b[A\x1b[3~x", []rune{keyUp, keyDelete, 'x'}},
+		{"ss3", "\x1bOH\x1bOF", []rune{keyHome, keyEnd}},
+		{"unknown csi", "\x1b[1;5Zx", []rune{keyUnknown, 'x'}},
+		{"alt key", "\x1bxy", []rune{keyUnknown, 'x', 'y'}},
+		{"escape twice", "\x1b\x1b[C", []rune{keyUnknown, keyRight}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, _ := testEditor(tt.input)
+
+			var got []rune
+			for {
+				r, err := e.readKey()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, r)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompleteWord(t *testing.T) {
+	words := []string{"print", "println", "push", "var", "ébc", "ébd"}
+	tests := []struct {
+		name    string
+		line    string
+		pos     int
+		want    string
+		wantPos int
+		wantOut string
+	}{
+		{name: "one completion", line: "pu", pos: 2, want: "push", wantPos: 4},
+		{name: "common prefix", line: "x = pr", pos: 6, want: "x = print", wantPos: 9},
+		{name: "nothing in common", line: "p", pos: 1, want: "p", wantPos: 1,
+			wantOut: "\r\nprint  println  push\r\n"},
+		{name: "no completions", line: "zz", pos: 2, want: "zz", wantPos: 2, wantOut: "\a"},
+		{name: "no word", line: "print ", pos: 6, want: "print ", wantPos: 6},
+		{name: "middle of the line", line: "pu(1)", pos: 2, want: "push(1)", wantPos: 4},
+		{name: "multibyte", line: "é", pos: 1, want: "éb", wantPos: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, out := testEditor("", words...)
+			e.buf = []rune(tt.line)
+			e.pos = tt.pos
+
+			e.completeWord()
+
+			if got := string(e.buf); got != tt.want || e.pos != tt.wantPos {
+				t.Errorf("got %q with the cursor at %d, want %q at %d", got, e.pos, tt.want, tt.wantPos)
+			}
+			if out.String() != tt.wantOut {
+				t.Errorf("printed %q, want %q", out.String(), tt.wantOut)
+			}
+		})
+	}
+}
+
+func TestSearch(t *testing.T) {
+	history := []string{"var abc = 1;", "print 2;", "print abc;"}
+	tests := []struct {
+		name  string
+		input string
+		want  string
+		key   rune // key that ended the search
+	}{
+		{name: "newest match", input: "abc\r", want: "print abc;", key: enter},
+		{name: "older match", input: "abc\x12\r", want: "var abc = 1;", key: enter},
+		{name: "no older match", input: "abc\x12\x12\r", want: "var abc = 1;", key: enter},
+		{name: "backspace", input: "abx\x7f\r", want: "print abc;", key: enter},
+		{name: "failing", input: "zzz\r", want: "typed", key: enter},
+		{name: "cancel", input: "2\x07", want: "typed", key: keyUnknown},
+		{name: "other key", input: "2\x01", want: "print 2;", key: ctrlA},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, _ := testEditor(tt.input)
+			e.history = history
+			e.setLine([]rune("typed"))
+
+			key, err := e.search()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := string(e.buf); got != tt.want {
+				t.Errorf("got line %q, want %q", got, tt.want)
+			}
+			if key != tt.key {
+				t.Errorf("got key %d, want %d", key, tt.key)
+			}
+		})
+	}
+}
+
+func TestAddHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history")
+	e, _ := testEditor("")
+	e.histPath = path
+
+	for _, line := range []string{"a", "a", "", "  ", "b", "a"} {
+		e.addHistory(line)
+	}
+
+	want := []string{"a", "b", "a"}
+	if !reflect.DeepEqual(e.history, want) {
+		t.Errorf("got history %q, want %q", e.history, want)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(data); got != "a\nb\na\n" {
+		t.Errorf("got history file %q, want %q", got, "a\nb\na\n")
+	}
+}
+
+func TestAddHistoryTruncates(t *testing.T) {
+	e, _ := testEditor("")
+	for i := 0; i < maxHistory+10; i++ {
+		e.addHistory(fmt.Sprint(i))
+	}
+
+	if len(e.history) != maxHistory {
+		t.Fatalf("got %d entries, want %d", len(e.history), maxHistory)
+	}
+	if first, last := e.history[0], e.history[maxHistory-1]; first != "10" || last != fmt.Sprint(maxHistory+9) {
+		t.Errorf("got entries %s to %s, want 10 to %d", first, last, maxHistory+9)
+	}
+}
+
+// When the input isn't a terminal, lines are read as they are, escape
+// sequences and all.
+func TestReadLineNotTerminal(t *testing.T) {
+	e, out := testEditor("print 1;\n\x1b[Ax\nlast")
+
+	for _, want := range []string{"print 1;", "\x1b[Ax"} {
+		line, err := e.readLine("> ")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != want {
+			t.Errorf("got %q, want %q", line, want)
+		}
+	}
+
+	line, err := e.readLine("> ")
+	if line != "last" || err != io.EOF {
+		t.Errorf("got %q, %v, want %q, EOF", line, err, "last")
+	}
+
+	if got := out.String(); got != "> > > " {
+		t.Errorf("printed %q, want %q", got, "> > > ")
+	}
+	if len(e.history) != 0 {
+		t.Errorf("got history %q, want none", e.history)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd
+
+package main
+
+import "errors"
+
+// Raw mode isn't supported here, so the REPL reads plain lines.
+func makeRaw(fd int) (func(), error) {
+	return nil, errors.New("line editing isn't supported on this platform")
+}
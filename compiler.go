@@ -0,0 +1,753 @@
+package deslang
+
+import (
+	"math"
+)
+
+// Maximum number of locals or upvalues in a single function. Both are
+// addressed with a one byte operand.
+const maxLocals = 256
+
+// Turns the parsed statements into bytecode for the VM. Each function body gets
+// its own compiler, linked to the compiler of the enclosing function so
+// variables from outer functions can be captured as upvalues. Statements are
+// expected to have been checked by the Resolver first; the compiler only
+// reports limits of the bytecode format, like too many constants, to the
+// errorHandler.
+type compiler struct {
+	errh       errorHandler
+	enclosing  *compiler
+	fn         *funcProto
+	kind       funKind
+	locals     []local
+	upvalues   []upvalueRef
+	scopeDepth int
+	loop       *loopInfo // innermost loop, nil if not inside one
+	pos        Span      // position of the node being compiled
+	temps      int       // values on the stack above the locals
+}
+
+type local struct {
+	name     string
+	depth    int  // -1 until the variable's initializer has been compiled
+	captured bool // closed over by a nested function
+}
+
+type upvalueRef struct {
+	index   byte
+	isLocal bool // index is a local slot of the enclosing function, otherwise one of its upvalues
+}
+
+// Used for compiling break and continue.
+type loopInfo struct {
+	enclosing  *loopInfo
+	start      int   // where continue jumps back to
+	scopeDepth int   // locals deeper than this are discarded when jumping out
+	breaks     []int // break jumps to patch once the end of the loop is known
+}
+
+// Compile the top-level statements of a program into a function for the VM.
+// Returns nil if there was an error.
+func compile(stmts []Stmt, errh errorHandler) *funcProto {
+	hadErr := false
+	c := newCompiler(nil, noFun, "", func(d Diagnostic) {
+		hadErr = true
+		errh(d)
+	})
+
+	for _, s := range stmts {
+		c.stmt(s)
+	}
+
+	fn := c.end()
+	if hadErr {
+		return nil
+	}
+	return fn
+}
+
+func newCompiler(enclosing *compiler, kind funKind, name string, errh errorHandler) *compiler {
+	c := &compiler{
+		errh:      errh,
+		enclosing: enclosing,
+		fn:        &funcProto{name: name},
+		kind:      kind,
+	}
+
+	if enclosing != nil {
+		c.pos = enclosing.pos
+	}
+
+	// Slot 0 holds the function being called, or the instance for methods.
+	slot0 := ""
+	if kind == methodFun || kind == initFun {
+		slot0 = "this"
+	}
+	c.locals = append(c.locals, local{name: slot0})
+	c.fn.maxStack = 1
+
+	return c
+}
+
+func (c *compiler) error(msg string) {
+	c.errh(Diagnostic{Kind: CompileError, Line: c.pos.Line, Message: msg})
+}
+
+func (c *compiler) chunk() *Chunk {
+	return &c.fn.chunk
+}
+
+// Finish the function with an implicit return.
+func (c *compiler) end() *funcProto {
+	c.emitReturn()
+	return c.fn
+}
+
+// ----------------------------------------------------------------------------
+// Emitting bytecode
+
+func (c *compiler) emit(bytes ...byte) {
+	for _, b := range bytes {
+		c.chunk().write(b, c.pos)
+	}
+}
+
+func (c *compiler) emitOp(op opcode, operands ...byte) {
+	c.emit(byte(op))
+	c.emit(operands...)
+}
+
+func (c *compiler) emitShort(op opcode, operand int) {
+	c.emit(byte(op), byte(operand>>8), byte(operand))
+}
+
+// Point the instructions emitted next at pos. Nodes the Parser made up rather
+// than parsed have an empty Span and keep the position of what came before.
+func (c *compiler) setPos(pos Span) {
+	if pos.Line > 0 {
+		c.pos = pos
+	}
+}
+
+// Note that n more values are on the stack above the locals, keeping track of
+// the most stack the function needs so the VM can check a call fits before
+// making it.
+func (c *compiler) push(n int) {
+	c.temps += n
+	if size := len(c.locals) + c.temps; size > c.fn.maxStack {
+		c.fn.maxStack = size
+	}
+}
+
+func (c *compiler) makeConstant(v Value) int {
+	i := c.chunk().addConstant(v)
+	if i > math.MaxUint16 {
+		c.error("Too many constants in one chunk.")
+		return 0
+	}
+	return i
+}
+
+func (c *compiler) identifierConstant(name Token) int {
+	return c.makeConstant(StringValue(name.name()))
+}
+
+func (c *compiler) emitConstant(v Value) {
+	c.emitShort(opConstant, c.makeConstant(v))
+}
+
+// Emit a jump with a placeholder offset and return the offset's position so it
+// can be patched later.
+func (c *compiler) emitJump(op opcode) int {
+	c.emitShort(op, 0xffff)
+	return len(c.chunk().Code) - 2
+}
+
+// Point the jump at pos to the next instruction emitted.
+func (c *compiler) patchJump(pos int) {
+	jump := len(c.chunk().Code) - pos - 2
+	if jump > math.MaxUint16 {
+		c.error("Too much code to jump over.")
+	}
+
+	c.chunk().Code[pos] = byte(jump >> 8)
+	c.chunk().Code[pos+1] = byte(jump)
+}
+
+func (c *compiler) emitLoop(start int) {
+	offset := len(c.chunk().Code) - start + 3
+	if offset > math.MaxUint16 {
+		c.error("Loop body too large.")
+	}
+	c.emitShort(opLoop, offset)
+}
+
+func (c *compiler) emitReturn() {
+	if c.kind == initFun {
+		c.emitOp(opGetLocal, 0)
+	} else {
+		c.emitOp(opNil)
+	}
+	c.emitOp(opReturn)
+}
+
+// ----------------------------------------------------------------------------
+// Scopes and variables
+
+func (c *compiler) beginScope() {
+	c.scopeDepth++
+}
+
+func (c *compiler) endScope() {
+	c.scopeDepth--
+	c.discardLocals(c.scopeDepth)
+	for len(c.locals) > 0 && c.locals[len(c.locals)-1].depth > c.scopeDepth {
+		c.locals = c.locals[:len(c.locals)-1]
+	}
+}
+
+// Emit the instructions that remove the locals deeper than depth from the
+// stack, without forgetting about them at compile time. Captured locals are
+// moved off the stack so closures can keep using them.
+func (c *compiler) discardLocals(depth int) {
+	for i := len(c.locals) - 1; i >= 0 && c.locals[i].depth > depth; i-- {
+		if c.locals[i].captured {
+			c.emitOp(opCloseUpvalue)
+		} else {
+			c.emitOp(opPop)
+		}
+	}
+}
+
+func (c *compiler) addLocal(name string) {
+	if len(c.locals) >= maxLocals {
+		c.error("Too many local variables in function.")
+		return
+	}
+	c.locals = append(c.locals, local{name: name, depth: -1})
+	c.push(0)
+}
+
+func (c *compiler) markInitialized() {
+	if c.scopeDepth == 0 {
+		return
+	}
+	c.locals[len(c.locals)-1].depth = c.scopeDepth
+}
+
+// Declare a variable in the current scope. Variables in the top-level scope are
+// globals and don't need declaring.
+func (c *compiler) declareVariable(name Token) {
+	if c.scopeDepth == 0 {
+		return
+	}
+	c.addLocal(name.name())
+}
+
+// Finish defining a variable whose value is on top of the stack.
+func (c *compiler) defineVariable(name Token) {
+	if c.scopeDepth > 0 {
+		c.markInitialized()
+		return
+	}
+	c.emitShort(opDefineGlobal, c.identifierConstant(name))
+}
+
+func (c *compiler) resolveLocal(name string) int {
+	for i := len(c.locals) - 1; i >= 0; i-- {
+		if c.locals[i].name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (c *compiler) resolveUpvalue(name string) int {
+	if c.enclosing == nil {
+		return -1
+	}
+
+	if slot := c.enclosing.resolveLocal(name); slot >= 0 {
+		c.enclosing.locals[slot].captured = true
+		return c.addUpvalue(byte(slot), true)
+	}
+
+	if index := c.enclosing.resolveUpvalue(name); index >= 0 {
+		return c.addUpvalue(byte(index), false)
+	}
+
+	return -1
+}
+
+func (c *compiler) addUpvalue(index byte, isLocal bool) int {
+	for i, up := range c.upvalues {
+		if up.index == index && up.isLocal == isLocal {
+			return i
+		}
+	}
+
+	if len(c.upvalues) >= maxLocals {
+		c.error("Too many closure variables in function.")
+		return 0
+	}
+
+	c.upvalues = append(c.upvalues, upvalueRef{index: index, isLocal: isLocal})
+	c.fn.upvalueCount = len(c.upvalues)
+	return len(c.upvalues) - 1
+}
+
+func (c *compiler) getVariable(name Token) {
+	s := name.name()
+
+	if slot := c.resolveLocal(s); slot >= 0 {
+		c.emitOp(opGetLocal, byte(slot))
+	} else if index := c.resolveUpvalue(s); index >= 0 {
+		c.emitOp(opGetUpvalue, byte(index))
+	} else {
+		c.emitShort(opGetGlobal, c.identifierConstant(name))
+	}
+}
+
+// Assign the value on top of the stack, leaving it there.
+func (c *compiler) setVariable(name Token) {
+	s := name.name()
+
+	if slot := c.resolveLocal(s); slot >= 0 {
+		c.emitOp(opSetLocal, byte(slot))
+	} else if index := c.resolveUpvalue(s); index >= 0 {
+		c.emitOp(opSetUpvalue, byte(index))
+	} else {
+		c.emitShort(opSetGlobal, c.identifierConstant(name))
+	}
+}
+
+// ----------------------------------------------------------------------------
+// Statements
+
+func (c *compiler) stmts(stmts []Stmt) {
+	for _, s := range stmts {
+		c.stmt(s)
+	}
+}
+
+// Between statements every value on the stack belongs to a local.
+func (c *compiler) stmt(stmt Stmt) {
+	defer func() { c.temps = 0 }()
+
+	c.setPos(stmt.SourceSpan())
+
+	switch s := stmt.(type) {
+	case ExprStmt:
+		c.expr(s.Expr)
+		c.pos = s.Span
+		if s.Echo {
+			c.emitOp(opEcho)
+		} else {
+			c.emitOp(opPop)
+		}
+	case PrintStmt:
+		c.expr(s.Expr)
+		c.pos = s.Span
+		c.emitOp(opPrint)
+	case VarStmt:
+		c.pos = s.Name.span()
+		c.declareVariable(s.Name)
+		if s.Expr != nil {
+			c.expr(s.Expr)
+		} else {
+			c.emitOp(opNil)
+		}
+		c.pos = s.Name.span()
+		c.defineVariable(s.Name)
+	case AssignStmt:
+		c.expr(s.Expr)
+		c.pos = s.Name.span()
+		c.setVariable(s.Name)
+		c.emitOp(opPop)
+	case BlockStmt:
+		c.beginScope()
+		c.stmts(s.Stmts)
+		c.endScope()
+	case IfStmt:
+		c.ifStmt(s)
+	case WhileStmt:
+		c.whileStmt(s)
+	case ForStmt:
+		c.forStmt(s)
+	case ForInStmt:
+		c.forInStmt(s)
+	case BreakStmt:
+		c.pos = s.Keyword.span()
+		c.discardLocals(c.loop.scopeDepth)
+		c.loop.breaks = append(c.loop.breaks, c.emitJump(opJump))
+	case ContinueStmt:
+		c.pos = s.Keyword.span()
+		c.discardLocals(c.loop.scopeDepth)
+		c.emitLoop(c.loop.start)
+	case FunStmt:
+		c.pos = s.Name.span()
+		c.declareVariable(s.Name)
+		// Mark the name as initialized so the function can refer to itself.
+		c.markInitialized()
+		c.function(s, plainFun)
+		c.defineVariable(s.Name)
+	case ReturnStmt:
+		c.pos = s.Keyword.span()
+		if s.Value == nil || c.kind == initFun {
+			c.emitReturn()
+		} else {
+			c.expr(s.Value)
+			c.emitOp(opReturn)
+		}
+	case ClassStmt:
+		c.classStmt(s)
+	}
+}
+
+func (c *compiler) ifStmt(s IfStmt) {
+	c.expr(s.Cond)
+
+	thenJump := c.emitJump(opJumpIfFalse)
+	c.emitOp(opPop)
+	c.stmt(s.Then)
+
+	elseJump := c.emitJump(opJump)
+	c.patchJump(thenJump)
+	c.emitOp(opPop)
+	c.stmt(s.Else)
+
+	c.patchJump(elseJump)
+}
+
+func (c *compiler) beginLoop(start int) {
+	c.loop = &loopInfo{
+		enclosing:  c.loop,
+		start:      start,
+		scopeDepth: c.scopeDepth,
+	}
+}
+
+// Point the loop's break jumps at the next instruction.
+func (c *compiler) endLoop() {
+	for _, pos := range c.loop.breaks {
+		c.patchJump(pos)
+	}
+	c.loop = c.loop.enclosing
+}
+
+func (c *compiler) whileStmt(s WhileStmt) {
+	start := len(c.chunk().Code)
+	c.beginLoop(start)
+
+	c.expr(s.Cond)
+	exitJump := c.emitJump(opJumpIfFalse)
+	c.emitOp(opPop)
+
+	c.stmt(s.Body)
+	c.emitLoop(start)
+
+	c.patchJump(exitJump)
+	c.emitOp(opPop)
+	c.endLoop()
+}
+
+// The increment is compiled before the body, so the body jumps back to it and
+// it jumps back to the condition.
+func (c *compiler) forStmt(s ForStmt) {
+	c.beginScope()
+	c.stmt(s.Init)
+
+	start := len(c.chunk().Code)
+	c.expr(s.Cond)
+	exitJump := c.emitJump(opJumpIfFalse)
+	c.emitOp(opPop)
+
+	if s.Incr != nil {
+		bodyJump := c.emitJump(opJump)
+
+		incrStart := len(c.chunk().Code)
+		c.expr(s.Incr)
+		c.emitOp(opPop)
+		c.emitLoop(start)
+
+		start = incrStart
+		c.patchJump(bodyJump)
+	}
+
+	c.beginLoop(start)
+	c.stmt(s.Body)
+	c.emitLoop(start)
+
+	c.patchJump(exitJump)
+	c.emitOp(opPop)
+	c.endLoop()
+
+	c.endScope()
+}
+
+// The iterable and the position within it are kept in two hidden locals.
+// Every iteration opForIter pushes the loop variables, which become locals of
+// a scope that ends with the iteration, matching ForInStmt.Execute.
+func (c *compiler) forInStmt(s ForInStmt) {
+	c.beginScope()
+
+	c.expr(s.Iterable)
+	c.addLocal("")
+	c.markInitialized()
+	iterSlot := len(c.locals) - 1
+
+	c.emitConstant(NumberValue(0))
+	c.push(1)
+	c.addLocal("")
+	c.markInitialized()
+
+	start := len(c.chunk().Code)
+	c.beginLoop(start)
+
+	c.pos = s.Iterable.SourceSpan()
+	c.emitOp(opForIter, byte(iterSlot), byte(len(s.Vars)))
+	c.emit(0xff, 0xff)
+	exitJump := len(c.chunk().Code) - 2
+
+	c.beginScope()
+	for _, v := range s.Vars {
+		c.addLocal(v.name())
+		c.markInitialized()
+	}
+
+	if block, ok := s.Body.(BlockStmt); ok {
+		c.stmts(block.Stmts)
+	} else {
+		c.stmt(s.Body)
+	}
+
+	c.endScope()
+	c.emitLoop(start)
+
+	c.patchJump(exitJump)
+	c.endLoop()
+
+	c.endScope()
+}
+
+// Compile a function body with a new compiler and emit the instruction that
+// creates a closure of it.
+func (c *compiler) function(s FunStmt, kind funKind) {
+	fc := newCompiler(c, kind, s.Name.name(), c.errh)
+	fc.beginScope()
+
+	fc.fn.arity = len(s.Params)
+	for _, param := range s.Params {
+		fc.addLocal(param.name())
+		fc.markInitialized()
+	}
+
+	fc.stmts(s.Body)
+	fn := fc.end()
+
+	c.pos = s.Name.span()
+	c.emitShort(opClosure, c.makeConstant(Value{Kind: funcLit, ref: fn}))
+	for _, up := range fc.upvalues {
+		isLocal := byte(0)
+		if up.isLocal {
+			isLocal = 1
+		}
+		c.emit(isLocal, up.index)
+	}
+	c.push(1)
+}
+
+// When the class is a local, its slot is reserved with nil first so methods can
+// refer to it. Subclasses keep the superclass in a local called 'super' for as
+// long as the methods are being declared, matching the Environment created by
+// ClassStmt.Execute.
+func (c *compiler) classStmt(s ClassStmt) {
+	c.pos = s.Name.span()
+
+	slot := -1
+	if c.scopeDepth > 0 {
+		c.declareVariable(s.Name)
+		c.markInitialized()
+		c.emitOp(opNil)
+		slot = len(c.locals) - 1
+	}
+
+	if s.Superclass != nil {
+		c.beginScope()
+		c.expr(s.Superclass)
+		c.addLocal("super")
+		c.markInitialized()
+	}
+
+	c.pos = s.Name.span()
+	c.emitShort(opClass, c.identifierConstant(s.Name))
+	c.push(1)
+	if s.Superclass != nil {
+		c.pos = s.Superclass.Name.span()
+		c.emitOp(opInherit)
+	}
+
+	for _, method := range s.Methods {
+		kind := methodFun
+		if method.Name.name() == "init" {
+			kind = initFun
+		}
+		c.function(method, kind)
+		c.emitShort(opMethod, c.identifierConstant(method.Name))
+		c.temps-- // the method's closure
+	}
+
+	c.pos = s.Name.span()
+	if slot >= 0 {
+		c.emitOp(opSetLocal, byte(slot))
+		c.emitOp(opPop)
+	} else {
+		c.emitShort(opDefineGlobal, c.identifierConstant(s.Name))
+	}
+
+	if s.Superclass != nil {
+		c.endScope()
+	}
+}
+
+// ----------------------------------------------------------------------------
+// Expressions
+
+// Whatever an expression pushes while it's evaluated, it leaves only its value
+// on the stack.
+func (c *compiler) expr(expr Expr) {
+	defer func(temps int) {
+		c.temps = temps
+		c.push(1)
+	}(c.temps)
+
+	switch e := expr.(type) {
+	case BasicLit:
+		c.setPos(e.Span)
+		switch {
+		case e.Value.Kind == nilLit:
+			c.emitOp(opNil)
+		case e.Value.Kind == boolLit && e.Value.boolean:
+			c.emitOp(opTrue)
+		case e.Value.Kind == boolLit:
+			c.emitOp(opFalse)
+		default:
+			c.emitConstant(e.Value)
+		}
+	case Grouping:
+		c.expr(e.X)
+	case Unary:
+		c.expr(e.Right)
+		c.pos = e.Span
+		if e.Op.Type == _bang {
+			c.emitOp(opNot)
+		} else {
+			c.emitOp(opNegate)
+		}
+	case Binary:
+		c.expr(e.Left)
+		c.expr(e.Right)
+		c.pos = e.Span
+		c.emitOp(binaryOps[e.Op.Type])
+	case Logical:
+		c.logical(e)
+	case *Variable:
+		c.pos = e.Name.span()
+		c.getVariable(e.Name)
+	case *Assign:
+		c.expr(e.Value)
+		c.pos = e.Name.span()
+		c.setVariable(e.Name)
+	case *This:
+		c.pos = e.Keyword.span()
+		c.getVariable(e.Keyword)
+	case *Super:
+		c.pos = e.Keyword.span()
+		c.getVariable(Token{Lexeme: []byte("this"), Line: e.Keyword.Line})
+		c.push(1)
+		c.getVariable(e.Keyword)
+		c.push(1)
+		c.pos = e.Method.span()
+		c.emitShort(opGetSuper, c.identifierConstant(e.Method))
+	case Call:
+		c.expr(e.Callee)
+		for _, arg := range e.Args {
+			c.expr(arg)
+		}
+		c.pos = e.Span
+		c.emitOp(opCall, byte(len(e.Args)))
+	case Get:
+		c.expr(e.Object)
+		c.pos = e.Name.span()
+		c.emitShort(opGetProperty, c.identifierConstant(e.Name))
+	case Set:
+		c.expr(e.Object)
+		c.expr(e.Value)
+		c.pos = e.Name.span()
+		c.emitShort(opSetProperty, c.identifierConstant(e.Name))
+	case ListLit:
+		if len(e.Elements) > math.MaxUint16 {
+			c.error("Too many items in list literal.")
+		}
+		for _, el := range e.Elements {
+			c.expr(el)
+		}
+		c.pos = e.Span
+		c.emitShort(opList, len(e.Elements))
+	case MapLit:
+		c.pos = e.Brace.span()
+		c.emitOp(opMap)
+		c.push(1)
+		for i, k := range e.Keys {
+			c.expr(k)
+			c.expr(e.Values[i])
+			c.pos = k.SourceSpan()
+			c.emitOp(opMapEntry)
+		}
+	case Index:
+		c.expr(e.Object)
+		c.expr(e.Index)
+		c.pos = e.Span
+		c.emitOp(opIndexGet)
+	case SetIndex:
+		c.expr(e.Object)
+		c.expr(e.Index)
+		c.expr(e.Value)
+		c.pos = e.Span
+		c.emitOp(opIndexSet)
+	}
+}
+
+var binaryOps = map[tokentype]opcode{
+	_equal_equal:   opEqual,
+	_bang_equal:    opNotEqual,
+	_greater:       opGreater,
+	_greater_equal: opGreaterEqual,
+	_less:          opLess,
+	_less_equal:    opLessEqual,
+	_plus:          opAdd,
+	_minus:         opSubtract,
+	_star:          opMultiply,
+	_slash:         opDivide,
+}
+
+// The left operand is left on the stack as the result if it decides it.
+func (c *compiler) logical(e Logical) {
+	c.expr(e.Left)
+	c.pos = e.Op.span()
+
+	if e.Op.Type == _or {
+		elseJump := c.emitJump(opJumpIfFalse)
+		endJump := c.emitJump(opJump)
+		c.patchJump(elseJump)
+		c.emitOp(opPop)
+		c.expr(e.Right)
+		c.patchJump(endJump)
+		return
+	}
+
+	endJump := c.emitJump(opJumpIfFalse)
+	c.emitOp(opPop)
+	c.expr(e.Right)
+	c.patchJump(endJump)
+}
@@ -2,18 +2,40 @@
 package deslang
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"sort"
+	"strings"
 )
 
-type errorHandler func(int, string, string)
+type errorHandler func(Diagnostic)
+
+// Returned by Compile when src has syntax or resolver errors. The errors
+// themselves have already been printed via 'out' Writer.
+var ErrCompile = errors.New("program has errors and was not compiled")
+
+// Decides how an Interpreter executes programs. Both backends produce the same
+// output.
+type Backend int
+
+const (
+	// Execute the syntax tree directly. This is the default.
+	TreeWalker Backend = iota
+	// Compile to bytecode and run it on a stack-based virtual machine.
+	BytecodeVM
+)
 
 type Interpreter struct {
-	hadErr  bool // True if there as an error doing the process
-	scanner *Scanner
-	parser  *Parser
-	env     *Environment
-	out     io.Writer
+	diags     Diagnostics // errors found by the current call
+	scanner   *Scanner
+	parser    *Parser
+	resolver  *Resolver
+	env       *Environment
+	out       io.Writer
+	backend   Backend
+	vm        *vm // created the first time the BytecodeVM backend runs
+	gcPercent int
 }
 
 func NewInterpreter(out io.Writer) *Interpreter {
@@ -21,51 +43,295 @@ func NewInterpreter(out io.Writer) *Interpreter {
 
 	interpreter.scanner = NewScanner(interpreter.errh)
 	interpreter.parser = NewParser(interpreter.errh)
+	interpreter.resolver = NewResolver(interpreter.errh)
 	interpreter.env = NewEnvironment(true)
 	interpreter.out = out
+	interpreter.gcPercent = defaultGCPercent
+
+	for _, n := range stdlib {
+		interpreter.DefineNative(n.name, n.arity, n.fn)
+	}
 
 	return &interpreter
 }
 
-// Parser and Scanner will report any syntax errors by calling this method.
-func (interpreter *Interpreter) errh(line int, where string, msg string) {
-	interpreter.hadErr = true
-	fmt.Fprintf(interpreter.out, "[line %d] Error %s: %s\n", line, where, msg)
+// Expose a Go function to scripts as a global function called name. The number
+// of arguments is checked against arity before fn is called; a negative arity
+// accepts any number of arguments. Defining a name again replaces the previous
+// definition.
+//
+// Lists and maps passed to or returned by fn belong to the program. The
+// BytecodeVM frees them once the program can no longer reach them, so fn
+// shouldn't hold on to them after it returns.
+func (interpreter *Interpreter) DefineNative(name string, arity int, fn NativeFunc) {
+	interpreter.env.Define(name, funcValue(&native{
+		name:  name,
+		arity: arity,
+		fn:    fn,
+	}))
+}
+
+// Choose how Run executes programs. Functions and classes created by one backend
+// can't be used by the other, so the backend should be chosen before running
+// anything.
+func (interpreter *Interpreter) SetBackend(backend Backend) {
+	interpreter.backend = backend
 }
 
-// Scan, check for errors, parse, check for errors, interpret, print result or
-// any runtime errors. Will return an error if something unexpected goes wrong
-// while attempting to scan, e.g. an issue reading from src; this error has
-// nothing to do with syntax or runtime errors. Syntax errors, parsing errors,
-// runtime errors, and evaluated result are printed via 'out' Writer.
+// Turn REPL mode on or off. In REPL mode the value of every top-level expression
+// statement is printed, unless it's nil, and the ';' after an expression at the
+// end of the source may be left out. It's off by default, which is how scripts
+// are run.
+func (interpreter *Interpreter) SetREPL(on bool) {
+	interpreter.parser.repl = on
+}
+
+// Set how much the BytecodeVM's heap may grow, as a percentage of the heap left
+// after the last collection, before the garbage collector runs again. The
+// default is 100, i.e. collect once the heap doubles. A negative percentage
+// disables the collector, leaving memory to Go's own garbage collector. Returns
+// the previous setting.
+//
+// The tree-walking interpreter leaves memory management to Go and isn't affected.
+func (interpreter *Interpreter) SetGCPercent(percent int) int {
+	prev := interpreter.gcPercent
+	interpreter.gcPercent = percent
+	if interpreter.vm != nil {
+		interpreter.vm.setGCPercent(percent)
+	}
+	return prev
+}
+
+// Statistics about the BytecodeVM's garbage collector. All zero until the VM
+// has run something.
+func (interpreter *Interpreter) GCStats() GCStats {
+	if interpreter.vm == nil {
+		return GCStats{}
+	}
+	return interpreter.vm.stats()
+}
+
+// Scanner, Parser, Resolver and the compiler report errors by calling this
+// method.
+func (interpreter *Interpreter) errh(d Diagnostic) {
+	interpreter.diags = append(interpreter.diags, d)
+}
+
+// Print every diagnostic found by the current call via 'out' Writer, along with
+// the source it points at.
+func (interpreter *Interpreter) report() {
+	for _, d := range interpreter.diags {
+		fmt.Fprintln(interpreter.out, d)
+		if snippet := d.Snippet(); snippet != "" {
+			fmt.Fprintln(interpreter.out, snippet)
+		}
+		if trace := d.StackTrace(); trace != "" {
+			fmt.Fprintln(interpreter.out, trace)
+		}
+	}
+}
+
+// Scan, check for errors, parse, check for errors, resolve, check for errors,
+// interpret, print result or any runtime errors. Will return an error if
+// something unexpected goes wrong while attempting to scan, e.g. an issue
+// reading from src; this error has nothing to do with syntax or runtime errors.
+// Syntax errors, parsing errors, resolver errors, runtime errors, and evaluated
+// result are printed via 'out' Writer.
 //
 // Run should be called when parsing every new source of code. When running as a
-// REPL, Run should be called on every new line.
+// REPL, lines should be collected until Incomplete reports that they form whole
+// statements, then Run called on all of them together.
 func (interpreter *Interpreter) Run(src io.Reader) error {
-	interpreter.hadErr = false
+	_, err := interpreter.Exec(src)
+	interpreter.report()
+	return err
+}
+
+// The same as Run, except syntax, resolver and runtime errors are returned as
+// Diagnostics instead of being printed, so 'out' Writer only receives the
+// program's output. Diagnostics is empty if the program ran without errors.
+// Execution stops at the first runtime error, so there's at most one.
+func (interpreter *Interpreter) Exec(src io.Reader) (Diagnostics, error) {
+	defer interpreter.attachSource()
+
+	stmts, err := interpreter.parse(src)
+	if err != nil || len(interpreter.diags) > 0 {
+		return interpreter.diags, err
+	}
+
+	if interpreter.backend == BytecodeVM {
+		if fn := compile(stmts, interpreter.errh); fn != nil {
+			interpreter.interpretVM(fn)
+		}
+		return interpreter.diags, nil
+	}
+
+	for _, s := range stmts {
+		if err := s.Execute(interpreter.out, interpreter.env); err != nil {
+			interpreter.errh(runtimeDiagnostic(err))
+			break
+		}
+	}
+
+	return interpreter.diags, nil
+}
+
+// Report whether src stops partway through a statement, e.g. with an unclosed
+// brace, paren or string or a missing ';', so a REPL should read more input
+// before running it. Syntax errors before the end of src don't count; Run
+// reports them as usual. Nothing is run and no errors are reported.
+func (interpreter *Interpreter) Incomplete(src io.Reader) bool {
+	interpreter.diags = nil
+	defer func() { interpreter.diags = nil }()
 
 	tokens, err := interpreter.scanner.Scan(src)
 	if err != nil && err != io.EOF {
+		return false
+	}
+
+	if interpreter.scanner.open {
+		return true
+	}
+	if len(interpreter.diags) > 0 {
+		return false
+	}
+
+	interpreter.parser.Parse(tokens)
+	return interpreter.parser.cutShort
+}
+
+// Keywords and names of global variables starting with prefix, sorted, for
+// completing what's been typed so far in a REPL.
+func (interpreter *Interpreter) Completions(prefix string) []string {
+	var names []string
+
+	for kw := range keywords {
+		if strings.HasPrefix(kw, prefix) {
+			names = append(names, kw)
+		}
+	}
+
+	for name := range interpreter.env.names {
+		if _, isKeyword := keywords[name]; !isKeyword && strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// Compile src to bytecode and print the instructions instead of running them.
+// Errors are handled the same as Run, except there are no runtime errors.
+func (interpreter *Interpreter) Disassemble(src io.Reader) error {
+	defer interpreter.report()
+
+	stmts, err := interpreter.parse(src)
+	if err != nil || len(interpreter.diags) > 0 {
+		return err
+	}
+
+	if fn := compile(stmts, interpreter.errh); fn != nil {
+		disassemble(interpreter.out, fn)
+	}
+
+	return nil
+}
+
+// Compile src to bytecode and write it to w as a versioned, checksummed binary
+// that RunCompiled can execute later without the source. Nothing is written to
+// w if src has errors; they're printed via 'out' Writer and ErrCompile is
+// returned.
+func (interpreter *Interpreter) Compile(src io.Reader, w io.Writer) error {
+	defer interpreter.report()
+
+	stmts, err := interpreter.parse(src)
+	if err != nil {
+		return err
+	}
+	if len(interpreter.diags) > 0 {
+		return ErrCompile
+	}
+
+	fn := compile(stmts, interpreter.errh)
+	if fn == nil {
+		return ErrCompile
+	}
+
+	return writeCompiled(w, fn)
+}
+
+// Run a program written by Compile. Compiled programs always run on the
+// BytecodeVM backend. An error is returned if r doesn't hold a compiled program,
+// was compiled by an incompatible version of deslang, or is corrupt; runtime
+// errors are printed via 'out' Writer the same as Run.
+func (interpreter *Interpreter) RunCompiled(r io.Reader) error {
+	interpreter.diags = nil
+	defer interpreter.report()
+
+	fn, err := readCompiled(r)
+	if err != nil {
 		return err
 	}
 
-	if interpreter.hadErr {
-		return nil
+	interpreter.interpretVM(fn)
+	return nil
+}
+
+// Scan, parse and resolve src. Errors found along the way are collected in
+// diags, which is cleared first.
+func (interpreter *Interpreter) parse(src io.Reader) ([]Stmt, error) {
+	interpreter.diags = nil
+	defer interpreter.attachSource()
+
+	tokens, err := interpreter.scanner.Scan(src)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if len(interpreter.diags) > 0 {
+		return nil, nil
 	}
 
 	stmts := interpreter.parser.Parse(tokens)
 
-	if interpreter.hadErr {
-		return nil
+	if len(interpreter.diags) > 0 {
+		return nil, nil
 	}
 
-	for _, s := range stmts {
-		err := s.Execute(interpreter.out, interpreter.env)
-		if err != nil {
-			fmt.Fprintln(interpreter.out, err.Error())
-			return nil
+	interpreter.resolver.Resolve(stmts)
+	return stmts, nil
+}
+
+// Give every diagnostic with a position the source line it's on. This waits
+// until scanning is done since the Scanner reports errors before it has read the
+// rest of the line. Runtime errors don't keep the text they point at, so it's
+// taken from the source too.
+func (interpreter *Interpreter) attachSource() {
+	for i := range interpreter.diags {
+		d := &interpreter.diags[i]
+		if d.Column == 0 || d.Source != "" {
+			continue
+		}
+
+		d.Source = interpreter.scanner.sourceLine(d.Line)
+
+		if d.Kind == RuntimeError && d.Column <= len(d.Source) {
+			end := d.Column - 1 + d.Length
+			if end > len(d.Source) {
+				end = len(d.Source)
+			}
+			d.Token = d.Source[d.Column-1 : end]
 		}
 	}
+}
 
-	return nil
+func (interpreter *Interpreter) interpretVM(fn *funcProto) {
+	if interpreter.vm == nil {
+		interpreter.vm = newVM(interpreter.out, interpreter.env, interpreter.gcPercent)
+	}
+
+	if err := interpreter.vm.interpret(fn); err != nil {
+		interpreter.errh(runtimeDiagnostic(err))
+	}
 }
@@ -0,0 +1,59 @@
+package deslang
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestIncomplete(t *testing.T) {
+	tests := []struct {
+		name string
+		repl bool
+		src  string
+		want bool
+	}{
+		{name: "complete statement", src: `print 1;`, want: false},
+		{name: "empty", src: ``, want: false},
+		{name: "unclosed brace", src: "fun f() {\n  print 1;", want: true},
+		{name: "unclosed paren", src: `print (1 + `, want: true},
+		{name: "unclosed list", src: `var l = [1, 2`, want: true},
+		{name: "unterminated string", src: "print \"abc\n", want: true},
+		{name: "missing semicolon", src: `var a = 1`, want: true},
+		{name: "error before the end", src: "print ) 1;\n{", want: false},
+		{name: "bad character", src: `print 1 @`, want: false},
+		{name: "bare expression", src: `1 + 2`, want: true},
+		{name: "repl bare expression", repl: true, src: `1 + 2`, want: false},
+		{name: "repl unclosed paren", repl: true, src: `(1 + 2`, want: true},
+		{name: "repl statement without semicolon", repl: true, src: `var a = 1`, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out strings.Builder
+			interpreter := NewInterpreter(&out)
+			interpreter.SetREPL(tt.repl)
+
+			if got := interpreter.Incomplete(strings.NewReader(tt.src)); got != tt.want {
+				t.Errorf("Incomplete(%q) = %v, want %v", tt.src, got, tt.want)
+			}
+			if out.Len() > 0 {
+				t.Errorf("Incomplete printed %q", out.String())
+			}
+		})
+	}
+}
+
+// Incomplete doesn't leave errors behind for the next Run to report.
+func TestIncompleteThenRun(t *testing.T) {
+	interpreter := NewInterpreter(ioutil.Discard)
+	interpreter.Incomplete(strings.NewReader(`print ) ;`))
+
+	diags, err := interpreter.Exec(strings.NewReader(`print 1;`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diags) != 0 {
+		t.Errorf("got diagnostics %v, want none", diags)
+	}
+}
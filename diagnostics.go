@@ -0,0 +1,221 @@
+package deslang
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Which stage of running a program found an error.
+type DiagnosticKind int
+
+const (
+	// The Scanner or Parser found invalid syntax.
+	SyntaxError DiagnosticKind = iota
+	// The Resolver found a mistake in valid syntax, e.g. redeclaring a variable.
+	ResolveError
+	// The bytecode compiler hit one of its limits, e.g. too many constants.
+	CompileError
+	// The program failed while running.
+	RuntimeError
+)
+
+func (k DiagnosticKind) String() string {
+	switch k {
+	case SyntaxError:
+		return "syntax error"
+	case ResolveError:
+		return "resolve error"
+	case CompileError:
+		return "compile error"
+	case RuntimeError:
+		return "runtime error"
+	}
+	return fmt.Sprintf("DiagnosticKind(%d)", int(k))
+}
+
+// An error found while running a program.
+type Diagnostic struct {
+	Kind    DiagnosticKind
+	Line    int    // 0 if unknown
+	Column  int    // in bytes, starting at 1; 0 if unknown
+	Length  int    // number of bytes of source the error covers on Line
+	Token   string // text of the offending token, empty if there isn't one or it's unknown
+	AtEnd   bool   // the error is at the end of the source rather than a token
+	Message string
+	Source  string // text of Line, empty if unknown
+
+	// For runtime errors, the calls that were in progress, innermost first and
+	// ending with the top-level script. Consecutive identical calls, e.g. from
+	// deep recursion, are kept as one StackFrame, see Repeats.
+	Trace []StackFrame
+}
+
+// A call in progress when a runtime error happened.
+type StackFrame struct {
+	Function string // "script" for top-level code
+	Line     int    // line being run in the function
+	Repeats  int    // number of identical calls right after this one
+}
+
+func (f StackFrame) String() string {
+	if f.Function == "script" {
+		return fmt.Sprintf("[line %d] in script", f.Line)
+	}
+	return fmt.Sprintf("[line %d] in %s()", f.Line, f.Function)
+}
+
+// Format the diagnostic the way Run prints it.
+func (d Diagnostic) String() string {
+	if d.Kind == RuntimeError {
+		if d.Line == 0 {
+			return d.Message
+		}
+		return fmt.Sprintf("[line %d] %s", d.Line, d.Message)
+	}
+
+	var where string
+	switch {
+	case d.AtEnd:
+		where = "at end"
+	case d.Token != "":
+		where = "at '" + d.Token + "'"
+	}
+
+	return fmt.Sprintf("[line %d] Error %s: %s", d.Line, where, d.Message)
+}
+
+// The offending source line with a caret underline beneath the part the error
+// covers, e.g.
+//
+//	print (1 + ;
+//	           ^
+//
+// Empty if the position isn't known.
+func (d Diagnostic) Snippet() string {
+	if d.Column == 0 || d.Column > len(d.Source)+1 {
+		return ""
+	}
+
+	// Copy tabs so the caret lines up however wide they're displayed.
+	var b strings.Builder
+	b.WriteString(d.Source)
+	b.WriteByte('\n')
+	for _, c := range d.Source[:d.Column-1] {
+		if c == '\t' {
+			b.WriteByte('\t')
+		} else {
+			b.WriteByte(' ')
+		}
+	}
+
+	length := d.Length
+	if rest := len(d.Source) - d.Column + 1; length > rest {
+		length = rest
+	}
+	if length < 1 {
+		length = 1
+	}
+	b.WriteString(strings.Repeat("^", length))
+
+	return b.String()
+}
+
+// The stack trace, one frame per line. Repeated frames are summed up in a line
+// after the first, e.g.
+//
+//	[line 1] in r()
+//	... 253 more calls to r()
+//	[line 2] in script
+//
+// Empty unless the error happened inside a function, since the trace would
+// only repeat the line of the error.
+func (d Diagnostic) StackTrace() string {
+	if len(d.Trace) < 2 {
+		return ""
+	}
+
+	var lines []string
+	for _, f := range d.Trace {
+		lines = append(lines, f.String())
+		switch {
+		case f.Repeats == 1:
+			lines = append(lines, f.String())
+		case f.Repeats > 1:
+			lines = append(lines, fmt.Sprintf("... %d more calls to %s()", f.Repeats, f.Function))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Every error found by one call to Interpreter.Exec, in the order they were
+// found.
+type Diagnostics []Diagnostic
+
+// Create a diagnostic pointing at t.
+func tokenDiagnostic(kind DiagnosticKind, t Token, msg string) Diagnostic {
+	d := Diagnostic{
+		Kind:    kind,
+		Line:    t.Line,
+		Column:  t.Column,
+		Length:  t.End - t.Start,
+		Message: msg,
+	}
+
+	if t.Type == _eof {
+		d.AtEnd = true
+	} else {
+		d.Token = string(t.Lexeme)
+	}
+
+	return d
+}
+
+// Create a diagnostic for an error returned by executing a program, which has
+// propagated out of every call up to the top-level script.
+func runtimeDiagnostic(err error) Diagnostic {
+	re, ok := err.(*runtimeError)
+	if !ok {
+		return Diagnostic{Kind: RuntimeError, Message: err.Error()}
+	}
+
+	return Diagnostic{
+		Kind:    RuntimeError,
+		Line:    re.pos.Line,
+		Column:  re.pos.Column,
+		Length:  re.pos.End - re.pos.Start,
+		Message: re.msg,
+		Trace:   append(re.trace, StackFrame{Function: "script", Line: re.at}),
+	}
+}
+
+// A runtime error raised at a known position, see lineError. As the error
+// propagates out of function calls, each one is added to trace.
+type runtimeError struct {
+	pos   Span // where the error happened
+	msg   string
+	trace []StackFrame
+	at    int // line in the function the error is currently propagating out of
+}
+
+func (e *runtimeError) Error() string {
+	return fmt.Sprintf("[line %d] %s", e.pos.Line, e.msg)
+}
+
+// Record that the error propagated out of the function called name, which was
+// called on callLine.
+func (e *runtimeError) unwind(name string, callLine int) {
+	if n := len(e.trace); n > 0 && e.trace[n-1].Function == name && e.trace[n-1].Line == e.at {
+		e.trace[n-1].Repeats++
+	} else {
+		e.trace = append(e.trace, StackFrame{Function: name, Line: e.at})
+	}
+	e.at = callLine
+}
+
+// Give err the position pos unless it already has one.
+func withPos(err error, pos Span) error {
+	if _, ok := err.(*runtimeError); ok {
+		return err
+	}
+	return errorAt(pos, "%s", err.Error())
+}
@@ -0,0 +1,31 @@
+package deslang
+
+import "testing"
+
+func TestStackTrace(t *testing.T) {
+	tests := []struct {
+		name  string
+		trace []StackFrame
+		want  string
+	}{
+		{"script only", []StackFrame{{Function: "script", Line: 1}}, ""},
+		{"one repeat", []StackFrame{
+			{Function: "f", Line: 2, Repeats: 1},
+			{Function: "script", Line: 4},
+		}, "[line 2] in f()\n[line 2] in f()\n[line 4] in script"},
+		{"many repeats", []StackFrame{
+			{Function: "g", Line: 1},
+			{Function: "f", Line: 2, Repeats: 9},
+			{Function: "script", Line: 4},
+		}, "[line 1] in g()\n[line 2] in f()\n... 9 more calls to f()\n[line 4] in script"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := Diagnostic{Kind: RuntimeError, Trace: tt.trace}
+			if got := d.StackTrace(); got != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
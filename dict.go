@@ -0,0 +1,71 @@
+package deslang
+
+import (
+	"strings"
+)
+
+// Created with a map literal, e.g. {"a": 1}. Keys are strings or numbers.
+// Entries are kept in insertion order so printing and iterating are
+// predictable.
+type dict struct {
+	gcHeader
+	keys   []Value
+	values []Value
+	index  map[Value]int // position of each key in keys and values
+}
+
+func newDict() *dict {
+	return &dict{index: make(map[Value]int)}
+}
+
+func checkKey(key Value, pos Span) error {
+	if key.Kind != stringLit && key.Kind != floatLit {
+		return errorAt(pos, "Map keys must be strings or numbers, got %s.", key.Type())
+	}
+	return nil
+}
+
+func (d *dict) get(key Value) (Value, bool) {
+	if i, has := d.index[key]; has {
+		return d.values[i], true
+	}
+	return Nil, false
+}
+
+func (d *dict) set(key, val Value) {
+	if i, has := d.index[key]; has {
+		d.values[i] = val
+		return
+	}
+
+	d.index[key] = len(d.keys)
+	d.keys = append(d.keys, key)
+	d.values = append(d.values, val)
+}
+
+func (d *dict) String() string {
+	return d.format(printing{})
+}
+
+func (d *dict) format(seen printing) string {
+	if seen[d] {
+		return "{...}"
+	}
+	seen[d] = true
+	defer delete(seen, d)
+
+	var b strings.Builder
+
+	b.WriteByte('{')
+	for i, key := range d.keys {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(seen.repr(key))
+		b.WriteString(": ")
+		b.WriteString(seen.repr(d.values[i]))
+	}
+	b.WriteByte('}')
+
+	return b.String()
+}
@@ -0,0 +1,142 @@
+package deslang
+
+import (
+	"fmt"
+	"io"
+)
+
+var opNames = map[opcode]string{
+	opConstant:     "OP_CONSTANT",
+	opNil:          "OP_NIL",
+	opTrue:         "OP_TRUE",
+	opFalse:        "OP_FALSE",
+	opPop:          "OP_POP",
+	opGetLocal:     "OP_GET_LOCAL",
+	opSetLocal:     "OP_SET_LOCAL",
+	opGetGlobal:    "OP_GET_GLOBAL",
+	opDefineGlobal: "OP_DEFINE_GLOBAL",
+	opSetGlobal:    "OP_SET_GLOBAL",
+	opGetUpvalue:   "OP_GET_UPVALUE",
+	opSetUpvalue:   "OP_SET_UPVALUE",
+	opGetProperty:  "OP_GET_PROPERTY",
+	opSetProperty:  "OP_SET_PROPERTY",
+	opGetSuper:     "OP_GET_SUPER",
+	opEqual:        "OP_EQUAL",
+	opNotEqual:     "OP_NOT_EQUAL",
+	opGreater:      "OP_GREATER",
+	opGreaterEqual: "OP_GREATER_EQUAL",
+	opLess:         "OP_LESS",
+	opLessEqual:    "OP_LESS_EQUAL",
+	opAdd:          "OP_ADD",
+	opSubtract:     "OP_SUBTRACT",
+	opMultiply:     "OP_MULTIPLY",
+	opDivide:       "OP_DIVIDE",
+	opNot:          "OP_NOT",
+	opNegate:       "OP_NEGATE",
+	opPrint:        "OP_PRINT",
+	opJump:         "OP_JUMP",
+	opJumpIfFalse:  "OP_JUMP_IF_FALSE",
+	opLoop:         "OP_LOOP",
+	opCall:         "OP_CALL",
+	opClosure:      "OP_CLOSURE",
+	opCloseUpvalue: "OP_CLOSE_UPVALUE",
+	opReturn:       "OP_RETURN",
+	opClass:        "OP_CLASS",
+	opInherit:      "OP_INHERIT",
+	opMethod:       "OP_METHOD",
+	opList:         "OP_LIST",
+	opMap:          "OP_MAP",
+	opMapEntry:     "OP_MAP_ENTRY",
+	opIndexGet:     "OP_INDEX_GET",
+	opIndexSet:     "OP_INDEX_SET",
+	opForIter:      "OP_FOR_ITER",
+	opEcho:         "OP_ECHO",
+}
+
+// Print every instruction of fn's chunk, followed by the chunks of any
+// functions declared inside it.
+func disassemble(w io.Writer, fn *funcProto) {
+	fmt.Fprintf(w, "== %s ==\n", fn.String())
+
+	c := &fn.chunk
+	for offset := 0; offset < len(c.Code); {
+		offset = disassembleInstruction(w, c, offset)
+	}
+
+	for _, constant := range c.Constants {
+		if nested, ok := constant.ref.(*funcProto); ok {
+			fmt.Fprintln(w)
+			disassemble(w, nested)
+		}
+	}
+}
+
+// Print the instruction at offset and return the offset of the next one. Each
+// line has the offset, the source line ('|' when it's the same as the previous
+// instruction), the instruction name and its operands.
+func disassembleInstruction(w io.Writer, c *Chunk, offset int) int {
+	fmt.Fprintf(w, "%04d ", offset)
+	if offset > 0 && c.Spans[offset].Line == c.Spans[offset-1].Line {
+		fmt.Fprint(w, "   | ")
+	} else {
+		fmt.Fprintf(w, "%4d ", c.Spans[offset].Line)
+	}
+
+	op := opcode(c.Code[offset])
+	name, known := opNames[op]
+	if !known {
+		fmt.Fprintf(w, "Unknown opcode %d\n", op)
+		return offset + 1
+	}
+
+	switch op {
+	case opConstant, opGetGlobal, opDefineGlobal, opSetGlobal, opGetProperty,
+		opSetProperty, opGetSuper, opClass, opMethod:
+		index := c.readShort(offset + 1)
+		fmt.Fprintf(w, "%-16s %4d %s\n", name, index, reprValue(c.Constants[index]))
+		return offset + 3
+
+	case opGetLocal, opSetLocal, opGetUpvalue, opSetUpvalue, opCall:
+		fmt.Fprintf(w, "%-16s %4d\n", name, c.Code[offset+1])
+		return offset + 2
+
+	case opList:
+		fmt.Fprintf(w, "%-16s %4d\n", name, c.readShort(offset+1))
+		return offset + 3
+
+	case opJump, opJumpIfFalse:
+		jump := c.readShort(offset + 1)
+		fmt.Fprintf(w, "%-16s %4d -> %d\n", name, offset, offset+3+jump)
+		return offset + 3
+
+	case opLoop:
+		jump := c.readShort(offset + 1)
+		fmt.Fprintf(w, "%-16s %4d -> %d\n", name, offset, offset+3-jump)
+		return offset + 3
+
+	case opForIter:
+		slot, count := c.Code[offset+1], c.Code[offset+2]
+		jump := c.readShort(offset + 3)
+		fmt.Fprintf(w, "%-16s %4d %d vars -> %d\n", name, slot, count, offset+5+jump)
+		return offset + 5
+
+	case opClosure:
+		index := c.readShort(offset + 1)
+		fn := c.Constants[index].ref.(*funcProto)
+		fmt.Fprintf(w, "%-16s %4d %s\n", name, index, fn)
+
+		offset += 3
+		for i := 0; i < fn.upvalueCount; i++ {
+			kind := "upvalue"
+			if c.Code[offset] == 1 {
+				kind = "local"
+			}
+			fmt.Fprintf(w, "%04d    |                     %s %d\n", offset, kind, c.Code[offset+1])
+			offset += 2
+		}
+		return offset
+	}
+
+	fmt.Fprintln(w, name)
+	return offset + 1
+}
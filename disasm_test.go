@@ -0,0 +1,55 @@
+package deslang
+
+import (
+	"strings"
+	"testing"
+)
+
+// Every instruction is shown with the line of the source it came from.
+func TestDisassembleLines(t *testing.T) {
+	src := `print 1;
+print 2;
+for (x in [
+  3]) {
+  print x;
+}
+fun f() {
+  return nil;
+}
+`
+	want := `== <script> ==
+0000    1 OP_CONSTANT         0 1
+0003    | OP_PRINT
+0004    2 OP_CONSTANT         1 2
+0007    | OP_PRINT
+0008    4 OP_CONSTANT         2 3
+0011    3 OP_LIST             1
+0014    | OP_CONSTANT         3 0
+0017    | OP_FOR_ITER         1 1 vars -> 29
+0022    5 OP_GET_LOCAL        3
+0024    | OP_PRINT
+0025    | OP_POP
+0026    | OP_LOOP            26 -> 17
+0029    | OP_POP
+0030    | OP_POP
+0031    7 OP_CLOSURE          4 <fn f>
+0034    | OP_DEFINE_GLOBAL    5 "f"
+0037    | OP_NIL
+0038    | OP_RETURN
+
+== <fn f> ==
+0000    8 OP_NIL
+0001    | OP_RETURN
+0002    | OP_NIL
+0003    | OP_RETURN
+`
+
+	var out strings.Builder
+	if err := NewInterpreter(&out).Disassemble(strings.NewReader(src)); err != nil {
+		t.Fatal(err)
+	}
+
+	if out.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", out.String(), want)
+	}
+}
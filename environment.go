@@ -1,57 +1,98 @@
 package deslang
 
-import (
-	"errors"
-)
-
 // lookup table for declared variables
+//
+// Local variables are stored in the order they're defined, which is the same
+// order the Resolver declares them in, so they're looked up by the slot the
+// Resolver gives them instead of by name. Globals can be referred to before
+// they're defined, so the global scope also keeps a hash table from each name
+// to its slot.
 type Environment struct {
-	values    map[string]BasicLit
-	Enclosing *Environment // parent scope
-	global    bool         // global scope
+	values    []Value
+	names     map[string]int // global scope only: slot of every defined name
+	Enclosing *Environment   // parent scope
+	global    bool           // global scope
+	calls     int            // global scope only: number of calls in progress
 }
 
 func NewEnvironment(global bool) *Environment {
-	return &Environment{
-		values: make(map[string]BasicLit),
-		global: global,
+	env := &Environment{global: global}
+	if global {
+		env.names = make(map[string]int)
 	}
+	return env
 }
 
-func (env *Environment) Assign(tok Token, val BasicLit) error {
-	s := string(tok.Lexeme)
-	if _, has := env.values[s]; has {
-		env.values[s] = val
+// Assign to a global variable.
+func (env *Environment) Assign(tok Token, val Value) error {
+	g := env.globals()
+	if i, has := g.names[tok.name()]; has {
+		g.values[i] = val
 		return nil
 	}
 
-	// As long as it hasn't reached the global scope, recursively check the chain
-	// of environments.
+	return lineError(tok, "Undefined variable '%s'.", tok.name())
+}
+
+// Define a variable in this scope. Defining a global again replaces its value.
+// Local names aren't kept since locals are accessed by slot.
+func (env *Environment) Define(name string, val Value) {
 	if !env.global {
-		err := env.Enclosing.Assign(tok, val)
-		if err != nil {
-			return err
-		}
+		env.values = append(env.values, val)
+		return
 	}
 
-	return errors.New("Undefined variable '" + s + "'.")
-}
+	if i, has := env.names[name]; has {
+		env.values[i] = val
+		return
+	}
 
-func (env *Environment) Define(name string, lit BasicLit) {
-	env.values[name] = lit
+	env.names[name] = len(env.values)
+	env.values = append(env.values, val)
 }
 
-func (env *Environment) Get(tok Token) (BasicLit, error) {
-	var lit BasicLit
+// Get a global variable.
+func (env *Environment) Get(tok Token) (Value, error) {
+	if val, has := env.globals().lookup(tok.name()); has {
+		return val, nil
+	}
+
+	return Nil, lineError(tok, "Undefined variable '%s'.", tok.name())
+}
 
-	// Recursively look for the variable.
-	lit, has := env.values[string(tok.Lexeme)]
+// Find a global by name. env must be the global scope.
+func (env *Environment) lookup(name string) (Value, bool) {
+	i, has := env.names[name]
 	if !has {
-		if env.global {
-			return lit, errors.New("Undefined variable '" + string(tok.Lexeme) + "'.")
-		}
-		return env.Enclosing.Get(tok)
+		return Nil, false
 	}
+	return env.values[i], true
+}
+
+// Walk the chain of environments up to the global scope.
+func (env *Environment) globals() *Environment {
+	for !env.global {
+		env = env.Enclosing
+	}
+	return env
+}
+
+// Walk up the chain of environments by the given distance.
+func (env *Environment) ancestor(distance int) *Environment {
+	for i := 0; i < distance; i++ {
+		env = env.Enclosing
+	}
+	return env
+}
+
+// Get a variable that the Resolver has already found at the given distance and
+// slot.
+func (env *Environment) GetAt(distance, slot int) Value {
+	return env.ancestor(distance).values[slot]
+}
 
-	return lit, nil
+// Assign a variable that the Resolver has already found at the given distance
+// and slot.
+func (env *Environment) AssignAt(distance, slot int, val Value) {
+	env.ancestor(distance).values[slot] = val
 }
@@ -0,0 +1,78 @@
+package deslang
+
+import (
+	"io"
+)
+
+// Any value that can be called, e.g. user-defined functions. A negative Arity
+// means any number of arguments is accepted.
+type Callable interface {
+	Arity() int
+	Call(*Environment, []Value) (Value, error)
+}
+
+// Used by ReturnStmt to unwind execution back to the caller. It's returned as
+// an error so that every Stmt between the return and the call passes it along
+// without having to know about it.
+type returnValue struct {
+	val Value
+}
+
+func (returnValue) Error() string {
+	return "Can't return from top-level code."
+}
+
+// User-defined function declared with 'fun', or a method declared in a class.
+type function struct {
+	decl    FunStmt
+	closure *Environment // scope the function was declared in
+	out     io.Writer    // where print statements in the body are written
+	isInit  bool         // class initializers always return 'this'
+}
+
+func (fn *function) Arity() int {
+	return len(fn.decl.Params)
+}
+
+// Each call gets its own Environment for the parameters, enclosed by the scope
+// the function was declared in rather than the scope of the caller.
+func (fn *function) Call(env *Environment, args []Value) (Value, error) {
+	local := NewEnvironment(false)
+	local.Enclosing = fn.closure
+
+	for i, param := range fn.decl.Params {
+		local.Define(param.name(), args[i])
+	}
+
+	err := executeBlock(fn.decl.Body, fn.out, local)
+	if ret, ok := err.(returnValue); ok {
+		if fn.isInit {
+			return fn.closure.values[0], nil
+		}
+		return ret.val, nil
+	}
+
+	if err == nil && fn.isInit {
+		return fn.closure.values[0], nil
+	}
+
+	return Nil, err
+}
+
+// Create a copy of the method whose closure defines 'this' as inst.
+func (fn *function) bind(inst *instance) *function {
+	env := NewEnvironment(false)
+	env.Enclosing = fn.closure
+	env.Define("this", instanceValue(inst))
+
+	return &function{
+		decl:    fn.decl,
+		closure: env,
+		out:     fn.out,
+		isInit:  fn.isInit,
+	}
+}
+
+func (fn *function) String() string {
+	return "<fn " + fn.decl.Name.name() + ">"
+}
@@ -0,0 +1,326 @@
+package deslang
+
+import (
+	"math"
+	"time"
+	"unsafe"
+)
+
+// Default for Interpreter.SetGCPercent.
+const defaultGCPercent = 100
+
+// The heap is never collected while it's smaller than this many bytes, so short
+// scripts don't pay for collections they don't need. Tests set it to 0 to
+// collect after every allocation.
+var gcMinHeap = 1 << 20
+
+// Statistics about the BytecodeVM's garbage collector, returned by
+// Interpreter.GCStats. Sizes are estimates of the memory used by runtime objects,
+// not exact allocations.
+type GCStats struct {
+	Collections int           // Number of collections run so far
+	Objects     int           // Objects currently managed by the collector
+	HeapBytes   int           // Estimated size of those objects
+	NextGC      int           // HeapBytes that triggers the next collection
+	Freed       int           // Objects freed by all collections so far
+	FreedBytes  int           // Estimated size of those objects
+	PauseTotal  time.Duration // Time spent collecting so far
+}
+
+// The VM owns every closure, upvalue, class, instance, bound method, list and
+// map it creates: each is kept in its heap until a collection finds nothing
+// can reach it. Once the heap grows past nextGC, the next instruction boundary
+// runs a mark-and-sweep collection: everything reachable from the stack, the
+// call frames, open upvalues and globals is marked, and every other object is
+// swept out of the heap and freed. Freeing drops everything the object refers
+// to, so its memory goes back to Go even if something outside the program,
+// like a native, still holds on to it. Stack slots above the top that calls
+// have used since the last collection are cleared as well, so values popped
+// long ago don't keep objects alive.
+//
+// Collections only run between instructions, when every live value is on the
+// stack or reachable from a root, so instructions can allocate freely.
+//
+// Strings are immutable Go strings stored inline in Values, so they aren't heap
+// objects, but their bytes are counted in the size of whatever holds them and
+// are reclaimed along with it.
+
+// Embedded in every kind of object the collector manages.
+type gcHeader struct {
+	owned bool   // in the VM's heap
+	mark  uint32 // the last collection that reached the object
+	size  int    // estimated size, while owned
+}
+
+func (h *gcHeader) header() *gcHeader {
+	return h
+}
+
+type heapObject interface {
+	header() *gcHeader
+}
+
+var (
+	valueSize   = int(unsafe.Sizeof(Value{}))
+	pointerSize = int(unsafe.Sizeof(uintptr(0)))
+	mapOverhead = 2 * pointerSize // rough per-entry cost of a Go map
+)
+
+// Estimated number of bytes used by obj.
+func objectSize(obj interface{}) int {
+	switch o := obj.(type) {
+	case *closure:
+		return int(unsafe.Sizeof(*o)) + len(o.upvalues)*pointerSize
+	case *upvalue:
+		return int(unsafe.Sizeof(*o)) + stringSize(o.closed)
+	case *vmClass:
+		return int(unsafe.Sizeof(*o)) + len(o.methods)*(pointerSize+mapOverhead)
+	case *vmInstance:
+		size := int(unsafe.Sizeof(*o))
+		for name, v := range o.fields {
+			size += len(name) + valueSize + stringSize(v) + mapOverhead
+		}
+		return size
+	case *boundMethod:
+		return int(unsafe.Sizeof(*o))
+	case *list:
+		size := int(unsafe.Sizeof(*o)) + cap(o.items)*valueSize
+		for _, item := range o.items {
+			size += stringSize(item)
+		}
+		return size
+	case *dict:
+		size := int(unsafe.Sizeof(*o)) + (cap(o.keys)+cap(o.values))*valueSize +
+			len(o.index)*(valueSize+mapOverhead)
+		for i, key := range o.keys {
+			size += stringSize(key) + stringSize(o.values[i])
+		}
+		return size
+	}
+	return 0
+}
+
+// Bytes of string data held by v.
+func stringSize(v Value) int {
+	if v.Kind == stringLit {
+		return len(v.str)
+	}
+	return 0
+}
+
+// Give obj to the VM's heap. Nothing is tracked while collection is disabled,
+// leaving objects to Go alone.
+func (vm *vm) track(obj heapObject) {
+	if vm.gcPercent < 0 {
+		return
+	}
+
+	h := obj.header()
+	h.owned = true
+	h.size = objectSize(obj)
+	vm.heap = append(vm.heap, obj)
+	vm.heapBytes += h.size
+}
+
+// Track any lists and maps in v that were created outside the VM, e.g. by
+// natives. Objects already in the heap are skipped along with everything they
+// reference.
+func (vm *vm) adopt(v Value) {
+	switch obj := v.ref.(type) {
+	case *list:
+		if obj.owned {
+			return
+		}
+		vm.track(obj)
+		for _, item := range obj.items {
+			vm.adopt(item)
+		}
+	case *dict:
+		if obj.owned {
+			return
+		}
+		vm.track(obj)
+		for _, val := range obj.values {
+			vm.adopt(val)
+		}
+	}
+}
+
+// Change how far the heap may grow past the live heap before the next
+// collection. A negative percent disables collection and hands every object in
+// the heap back to Go.
+func (vm *vm) setGCPercent(percent int) {
+	vm.gcPercent = percent
+	if percent < 0 {
+		for _, obj := range vm.heap {
+			obj.header().owned = false
+		}
+		vm.heap = nil
+		vm.heapBytes = 0
+	}
+	vm.updateNextGC()
+}
+
+func (vm *vm) updateNextGC() {
+	switch {
+	case vm.gcPercent < 0:
+		vm.nextGC = math.MaxInt32
+	case vm.heapBytes*(100+vm.gcPercent)/100 < gcMinHeap:
+		vm.nextGC = gcMinHeap
+	default:
+		vm.nextGC = vm.heapBytes * (100 + vm.gcPercent) / 100
+	}
+}
+
+func (vm *vm) collect() {
+	start := time.Now()
+
+	vm.gcCycle++
+	m := marker{cycle: vm.gcCycle, gray: vm.gray[:0]}
+	for _, v := range vm.stack[:vm.sp] {
+		m.markValue(v)
+	}
+	// Running closures are also in slot 0 of their frame, or in the class of
+	// the instance there, but they're marked in case that changes.
+	for _, frame := range vm.frames {
+		m.mark(frame.closure)
+	}
+	for up := vm.openUpvalues; up != nil; up = up.next {
+		m.mark(up)
+	}
+	for _, v := range vm.globals.values {
+		m.markValue(v)
+	}
+	m.trace()
+	vm.gray = m.gray
+
+	vm.heapBytes = 0
+	live := vm.heap[:0]
+	for _, obj := range vm.heap {
+		h := obj.header()
+		if h.mark != vm.gcCycle {
+			vm.gcStats.Freed++
+			vm.gcStats.FreedBytes += h.size
+			free(obj)
+			continue
+		}
+
+		// Measured again since lists and maps may have grown since they were
+		// tracked.
+		h.size = objectSize(obj)
+		vm.heapBytes += h.size
+		live = append(live, obj)
+	}
+	for i := len(live); i < len(vm.heap); i++ {
+		vm.heap[i] = nil
+	}
+	vm.heap = live
+
+	for i := vm.sp; i < vm.stackHigh; i++ {
+		vm.stack[i] = Value{}
+	}
+	vm.stackHigh = vm.sp
+	for _, frame := range vm.frames {
+		if top := frame.base + frame.closure.proto.maxStack; top > vm.stackHigh {
+			vm.stackHigh = top
+		}
+	}
+
+	vm.updateNextGC()
+	vm.gcStats.Collections++
+	vm.gcStats.PauseTotal += time.Since(start)
+}
+
+// Drop everything a swept object refers to and take it out of the VM's hands.
+func free(obj heapObject) {
+	obj.header().owned = false
+
+	switch o := obj.(type) {
+	case *closure:
+		o.upvalues = nil
+	case *upvalue:
+		o.closed = Nil
+		o.location = &o.closed
+	case *vmClass:
+		o.methods = nil
+	case *vmInstance:
+		o.fields = nil
+	case *boundMethod:
+		o.receiver = Nil
+		o.method = nil
+	case *list:
+		o.items = nil
+	case *dict:
+		o.keys, o.values, o.index = nil, nil, nil
+	}
+}
+
+func (vm *vm) stats() GCStats {
+	stats := vm.gcStats
+	stats.Objects = len(vm.heap)
+	stats.HeapBytes = vm.heapBytes
+	stats.NextGC = vm.nextGC
+	return stats
+}
+
+// Marked objects wait in gray until the objects they reference are marked too.
+// Objects are marked with the number of the collection, so marks from earlier
+// collections never need clearing. Objects outside the heap, like lists made by
+// the tree-walking interpreter, are traced too in case they hold some that are
+// in it.
+type marker struct {
+	cycle uint32
+	gray  []heapObject
+}
+
+func (m *marker) mark(obj interface{}) {
+	o, ok := obj.(heapObject)
+	if !ok || o.header().mark == m.cycle {
+		return
+	}
+
+	o.header().mark = m.cycle
+	m.gray = append(m.gray, o)
+}
+
+func (m *marker) markValue(v Value) {
+	if v.ref != nil {
+		m.mark(v.ref)
+	}
+}
+
+func (m *marker) trace() {
+	for len(m.gray) > 0 {
+		obj := m.gray[len(m.gray)-1]
+		m.gray = m.gray[:len(m.gray)-1]
+
+		switch o := obj.(type) {
+		case *closure:
+			for _, up := range o.upvalues {
+				m.mark(up)
+			}
+		case *upvalue:
+			m.markValue(*o.location)
+		case *vmClass:
+			for _, method := range o.methods {
+				m.mark(method)
+			}
+		case *vmInstance:
+			m.mark(o.class)
+			for _, v := range o.fields {
+				m.markValue(v)
+			}
+		case *boundMethod:
+			m.markValue(o.receiver)
+			m.mark(o.method)
+		case *list:
+			for _, item := range o.items {
+				m.markValue(item)
+			}
+		case *dict:
+			for _, v := range o.values {
+				m.markValue(v)
+			}
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package deslang
+
+import (
+	"io"
+	"io/ioutil"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// Creates 3000 lists that each hold a new 64 KB string, keeping only the last.
+const garbageProgram = `
+var big = "x";
+for (var i = 0; i < 16; i = i + 1) big = big + big;
+var keep = nil;
+for (var i = 0; i < 3000; i = i + 1) {
+	var l = [big + "y"];
+	keep = l;
+}
+`
+
+func heapInUse() uint64 {
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.HeapAlloc
+}
+
+// Running garbageProgram allocates around 200 MB. The VM's heap holds on to
+// every list until a collection sweeps it, so almost all of it must have been
+// swept for the memory to be released.
+func TestGCReleasesGarbage(t *testing.T) {
+	for _, percent := range []int{defaultGCPercent, 0} {
+		before := heapInUse()
+
+		interpreter := NewInterpreter(ioutil.Discard)
+		interpreter.SetBackend(BytecodeVM)
+		interpreter.SetGCPercent(percent)
+		if err := interpreter.Run(strings.NewReader(garbageProgram)); err != nil {
+			t.Fatal(err)
+		}
+
+		after := heapInUse()
+		runtime.KeepAlive(interpreter)
+
+		if after > before && after-before > 16<<20 {
+			t.Errorf("GC percent %d: %d MB still in use after running", percent, (after-before)>>20)
+		}
+
+		stats := interpreter.GCStats()
+		if stats.Collections == 0 {
+			t.Errorf("GC percent %d: no collections ran", percent)
+		}
+		if stats.Freed < 2900 {
+			t.Errorf("GC percent %d: only %d objects were freed", percent, stats.Freed)
+		}
+		if stats.Objects > 100 {
+			t.Errorf("GC percent %d: %d objects still in the heap", percent, stats.Objects)
+		}
+	}
+}
+
+// With collection disabled nothing is put in the heap, and turning it off
+// hands back what's already there.
+func TestGCDisabled(t *testing.T) {
+	interpreter := NewInterpreter(ioutil.Discard)
+	interpreter.SetBackend(BytecodeVM)
+	interpreter.Run(strings.NewReader(`var l = [[1], [2]];`))
+
+	if interpreter.GCStats().Objects == 0 {
+		t.Fatal("no objects in the heap")
+	}
+
+	interpreter.SetGCPercent(-1)
+	interpreter.Run(strings.NewReader(`var m = [[1], [2]];`))
+
+	if stats := interpreter.GCStats(); stats.Objects != 0 || stats.HeapBytes != 0 {
+		t.Errorf("got %d objects using %d bytes, want none", stats.Objects, stats.HeapBytes)
+	}
+}
+
+// Create an Interpreter that collects after every allocation, so any object the
+// marker fails to reach from a root is freed while the program still uses it.
+func stressGC(t *testing.T, out io.Writer) *Interpreter {
+	prev := gcMinHeap
+	gcMinHeap = 0
+	t.Cleanup(func() { gcMinHeap = prev })
+
+	interpreter := NewInterpreter(out)
+	interpreter.SetBackend(BytecodeVM)
+	interpreter.SetGCPercent(0)
+	return interpreter
+}
+
+// Objects reachable from each kind of root survive collections. A freed
+// object is emptied, so one the marker missed prints differently, or makes
+// the VM panic.
+func TestGCKeepsLiveObjects(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"stack temporaries", `print [[1], [2], {"a": [3]}];`, `[[1], [2], {"a": [3]}]`},
+		{"locals", `{
+			var l = [1, 2];
+			var m = {"k": [3]};
+			var junk = [0];
+			junk = [[0]];
+			print l; print m;
+		}`, "[1, 2]\n{\"k\": [3]}"},
+		{"globals", `
+			var g = [1, [2]];
+			var junk = [0];
+			junk = [[0]];
+			print g;`, "[1, [2]]"},
+		{"open upvalues", `
+			fun outer() {
+				var l = [1];
+				fun get() { return l; }
+				var junk = [[0]];
+				junk = [[0]];
+				return get();
+			}
+			print outer();`, "[1]"},
+		{"upvalues only the VM knows are open", `
+			fun outer() {
+				var l = [1];
+				{
+					fun discarded() { return l; }
+				}
+				var junk = [[0]];
+				junk = [[0]];
+				fun get() { return l; }
+				return get();
+			}
+			print outer();`, "[1]"},
+		{"closed upvalues", `
+			fun make() {
+				var l = [1];
+				fun get() { return l; }
+				return get;
+			}
+			var get = make();
+			var junk = [[0]];
+			print get();`, "[1]"},
+		{"call frames", `
+			class A {
+				init() { this.l = [1]; }
+				m() {
+					var junk = [[0]];
+					junk = [[0]];
+					return this.l;
+				}
+			}
+			print A().m();`, "[1]"},
+		{"instances and bound methods", `
+			class Box {
+				init(v) { this.v = v; }
+				get() { return this.v; }
+			}
+			var get = Box([1, {"k": [2]}]).get;
+			var junk = [[0]];
+			print get();`, "[1, {\"k\": [2]}]"},
+		{"classes only reachable from instances", `
+			fun make() {
+				var l = [1];
+				class C {
+					get() { return l; }
+				}
+				return C();
+			}
+			var c = make();
+			var junk = [[0]];
+			junk = [[0]];
+			print c.get();`, "[1]"},
+		{"natives", `
+			var l = [];
+			for (var i = 0; i < 3; i = i + 1) push(l, [i]);
+			var m = {"a": [1], "b": [2]};
+			print keys(m); print values(m); print slice(l, 1, 3);`,
+			"[\"a\", \"b\"]\n[[1], [2]]\n[[1], [2]]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out strings.Builder
+			interpreter := stressGC(t, &out)
+			interpreter.Run(strings.NewReader(tt.src))
+
+			if got := strings.TrimSuffix(out.String(), "\n"); got != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+			if interpreter.GCStats().Collections == 0 {
+				t.Error("no collections ran")
+			}
+		})
+	}
+}
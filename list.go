@@ -0,0 +1,76 @@
+package deslang
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Created with a list literal, e.g. [1, 2, 3]. Lists are mutable and shared by
+// reference.
+type list struct {
+	gcHeader
+	items []Value
+}
+
+func (l *list) String() string {
+	return l.format(printing{})
+}
+
+func (l *list) format(seen printing) string {
+	if seen[l] {
+		return "[...]"
+	}
+	seen[l] = true
+	defer delete(seen, l)
+
+	var b strings.Builder
+
+	b.WriteByte('[')
+	for i, item := range l.items {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(seen.repr(item))
+	}
+	b.WriteByte(']')
+
+	return b.String()
+}
+
+// Like Value.String but strings are quoted, so they can be told apart from
+// other values when printed inside a collection.
+func reprValue(v Value) string {
+	return printing{}.repr(v)
+}
+
+// The collections being printed. A collection that contains itself is printed
+// as [...] or {...} where it appears inside itself, instead of forever.
+type printing map[interface{}]bool
+
+func (seen printing) repr(v Value) string {
+	switch ref := v.ref.(type) {
+	case *list:
+		return ref.format(seen)
+	case *dict:
+		return ref.format(seen)
+	}
+
+	if v.Kind == stringLit {
+		return strconv.Quote(v.str)
+	}
+	return v.String()
+}
+
+// Convert an index Value to a position within a sequence of the given length.
+func checkIndex(idx Value, length int, pos Span) (int, error) {
+	if idx.Kind != floatLit || idx.num != float64(int(idx.num)) {
+		return 0, errorAt(pos, "Index must be a whole number.")
+	}
+
+	i := int(idx.num)
+	if i < 0 || i >= length {
+		return 0, errorAt(pos, "Index %d out of bounds for length %d.", i, length)
+	}
+
+	return i, nil
+}
@@ -0,0 +1,24 @@
+package deslang
+
+// Signature of functions implemented in Go. Returning an error reports it as a
+// runtime error in the script.
+type NativeFunc func(args []Value) (Value, error)
+
+// Function implemented in Go and registered with Interpreter.DefineNative.
+type native struct {
+	name  string
+	arity int // negative if any number of arguments is accepted
+	fn    NativeFunc
+}
+
+func (n *native) Arity() int {
+	return n.arity
+}
+
+func (n *native) Call(_ *Environment, args []Value) (Value, error) {
+	return n.fn(args)
+}
+
+func (n *native) String() string {
+	return "<native fn " + n.name + ">"
+}
@@ -3,247 +3,225 @@ package deslang
 import (
 	"fmt"
 	"io"
-	"strconv"
 )
 
-type litKind uint
-
-const (
-	nilLit litKind = iota
-	floatLit
-	stringLit
-	boolLit
-)
-
-var types = map[litKind]string{
-	nilLit:    "nil",
-	floatLit:  "float",
-	stringLit: "string",
-	boolLit:   "boolean",
-}
-
-func toFloat(s string) float64 {
-	// TODO: Handle err when converting string to int
-	f, _ := strconv.ParseFloat(s, 64)
-	return f
+// Runtime error that points at tok.
+func lineError(tok Token, format string, a ...interface{}) error {
+	return errorAt(tok.span(), format, a...)
 }
 
-func fromFloat(f float64) string {
-	return strconv.FormatFloat(f, 'E', -1, 64)
-}
-
-func isTruthy(lit BasicLit) bool {
-	switch lit.Kind {
-	case nilLit:
-		return false
-	case floatLit:
-		return lit.Value != "0"
-	case stringLit:
-		return len(lit.Value) > 0
-	case boolLit:
-		return lit.Value == "true"
-	default:
-		return false
-	}
+// Runtime error that points at pos, usually the Span of the node that failed.
+func errorAt(pos Span, format string, a ...interface{}) error {
+	return &runtimeError{pos: pos, at: pos.Line, msg: fmt.Sprintf(format, a...)}
 }
 
 // ----------------------------------------------------------------------------
 // Expressions
 
 type (
+	// Every node embeds the Span of source it was parsed from. Nodes made up by
+	// the Parser rather than parsed, like the condition of 'for (;;)', have an
+	// empty Span.
 	Expr interface {
-		Interpret(*Environment) (BasicLit, error)
+		Interpret(*Environment) (Value, error)
+		SourceSpan() Span
 	}
 
 	Unary struct {
+		Span
 		Right Expr
 		Op    Token
 	}
 
 	Binary struct {
+		Span
 		Left, Right Expr
 		Op          Token
 	}
 
+	// Depth is the number of scopes between the assignment and the variable's
+	// declaration, as computed by the Resolver. -1 means global. Slot is the
+	// variable's index within the declaring scope; globals are looked up by name
+	// instead.
 	Assign struct {
+		Span
 		Name  Token
 		Value Expr
+		Depth int
+		Slot  int
 	}
 
 	// (X)
 	Grouping struct {
+		Span
 		X Expr
 	}
 
+	// Depth and Slot are the same as in Assign.
 	Variable struct {
-		Name Token
+		Span
+		Name  Token
+		Depth int
+		Slot  int
 	}
 
 	// and, or
 	Logical struct {
+		Span
 		Left, Right Expr
 		Op          Token
 	}
 
-	// Primitive value. It's stored as a string and the Kind field is used to
-	// figure out typecasting. It would probably be faster to split this into a
-	// few structs based on type but this way is simpler.
+	// Callee(Args...)
+	// Paren is the closing parenthesis, used for reporting errors.
+	Call struct {
+		Span
+		Callee Expr
+		Paren  Token
+		Args   []Expr
+	}
+
+	// Object.Name
+	Get struct {
+		Span
+		Object Expr
+		Name   Token
+	}
+
+	// Object.Name = Value
+	Set struct {
+		Span
+		Object Expr
+		Name   Token
+		Value  Expr
+	}
+
+	// Depth is the same as in Assign. 'this' is always in slot 0.
+	This struct {
+		Span
+		Keyword Token
+		Depth   int
+	}
+
+	// super.Method
+	// Depth is the same as in Assign, pointing at the scope defining 'super' in
+	// slot 0.
+	Super struct {
+		Span
+		Keyword Token
+		Method  Token
+		Depth   int
+	}
+
+	// [Elements...]
+	ListLit struct {
+		Span
+		Elements []Expr
+	}
+
+	// {Keys[0]: Values[0], ...}
+	// Brace is the opening brace, used for reporting errors.
+	MapLit struct {
+		Span
+		Brace  Token
+		Keys   []Expr
+		Values []Expr
+	}
+
+	// Object[Index]
+	// Bracket is the opening bracket, used for reporting errors.
+	Index struct {
+		Span
+		Object  Expr
+		Bracket Token
+		Index   Expr
+	}
+
+	// Object[Index] = Value
+	SetIndex struct {
+		Span
+		Object  Expr
+		Bracket Token
+		Index   Expr
+		Value   Expr
+	}
+
+	// Literal value written in the source, e.g. 1, "one", true or nil.
 	BasicLit struct {
-		Value string
-		Kind  litKind
+		Span
+		Value Value
 	}
 )
 
 // ----------------------------------------------------------------------------
 // Interpretation methods
 
-func (expr Unary) Interpret(env *Environment) (BasicLit, error) {
-	var result BasicLit
-
+func (expr Unary) Interpret(env *Environment) (Value, error) {
 	right, err := expr.Right.Interpret(env)
 	if err != nil {
-		return result, err
+		return Nil, err
 	}
 
-	switch expr.Op.Type {
-	case _bang:
-		result.Kind = boolLit
-		if right.Kind == boolLit && right.Value == "true" {
-			result.Value = "false"
-		} else {
-			result.Value = "true"
-		}
-	case _minus:
-		result.Kind = floatLit
-		result.Value = fromFloat(-toFloat(right.Value))
+	result, err := unaryOp(expr.Op.Type, right)
+	if err != nil {
+		return Nil, withPos(err, expr.Span)
 	}
-
 	return result, nil
 }
 
-func (expr Binary) Interpret(env *Environment) (BasicLit, error) {
-	var result BasicLit
-
+func (expr Binary) Interpret(env *Environment) (Value, error) {
 	left, err := expr.Left.Interpret(env)
 	if err != nil {
-		return result, err
+		return Nil, err
 	}
 
 	right, err := expr.Right.Interpret(env)
 	if err != nil {
-		return result, err
+		return Nil, err
 	}
 
-	// Type check
-	if left.Kind != right.Kind {
-		err := fmt.Errorf(
-			"Invalid operation. Mismatched types %s and %s",
-			types[left.Kind],
-			types[right.Kind],
-		)
-		return result, err
-	}
-
-	switch expr.Op.Type {
-	case _plus:
-		if left.Kind == stringLit && right.Kind == stringLit {
-			result.Value = left.Value + right.Value
-			result.Kind = stringLit
-		} else {
-			result.Value = fromFloat(toFloat(left.Value) + toFloat(right.Value))
-			result.Kind = floatLit
-		}
-	case _minus:
-		result.Value = fromFloat(toFloat(left.Value) - toFloat(right.Value))
-		result.Kind = floatLit
-	case _slash:
-		result.Value = fromFloat(toFloat(left.Value) / toFloat(right.Value))
-		result.Kind = floatLit
-	case _star:
-		result.Value = fromFloat(toFloat(left.Value) * toFloat(right.Value))
-		result.Kind = floatLit
-	case _greater:
-		result.Kind = boolLit
-		if toFloat(left.Value) > toFloat(right.Value) {
-			result.Value = "true"
-		} else {
-			result.Value = "false"
-		}
-	case _greater_equal:
-		result.Kind = boolLit
-		if toFloat(left.Value) >= toFloat(right.Value) {
-			result.Value = "true"
-		} else {
-			result.Value = "false"
-		}
-	case _less:
-		result.Kind = boolLit
-		if toFloat(left.Value) < toFloat(right.Value) {
-			result.Value = "true"
-		} else {
-			result.Value = "false"
-		}
-	case _less_equal:
-		result.Kind = boolLit
-		if toFloat(left.Value) <= toFloat(right.Value) {
-			result.Value = "true"
-		} else {
-			result.Value = "false"
-		}
-	case _bang_equal:
-		result.Kind = boolLit
-		if left.Value == right.Value {
-			result.Value = "false"
-		} else {
-			result.Value = "true"
-		}
-	case _equal_equal:
-		result.Kind = boolLit
-		if left.Value == right.Value {
-			result.Value = "true"
-		} else {
-			result.Value = "false"
-		}
-	default:
-		result = BasicLit{Value: "", Kind: nilLit}
+	result, err := binaryOp(expr.Op.Type, left, right)
+	if err != nil {
+		return Nil, withPos(err, expr.Span)
 	}
-
 	return result, nil
 }
 
-func (expr Assign) Interpret(env *Environment) (BasicLit, error) {
-	var result BasicLit
-
+func (expr Assign) Interpret(env *Environment) (Value, error) {
 	result, err := expr.Value.Interpret(env)
 	if err != nil {
 		return result, err
 	}
 
-	env.Assign(expr.Name, result)
+	if expr.Depth < 0 {
+		return result, env.globals().Assign(expr.Name, result)
+	}
+
+	env.AssignAt(expr.Depth, expr.Slot, result)
 	return result, nil
 }
 
-func (expr Grouping) Interpret(env *Environment) (BasicLit, error) {
+func (expr Grouping) Interpret(env *Environment) (Value, error) {
 	return expr.X.Interpret(env)
 }
 
-func (expr BasicLit) Interpret(env *Environment) (BasicLit, error) {
-	return expr, nil
+func (expr BasicLit) Interpret(env *Environment) (Value, error) {
+	return expr.Value, nil
 }
 
-func (expr Variable) Interpret(env *Environment) (BasicLit, error) {
-	return env.Get(expr.Name)
+func (expr Variable) Interpret(env *Environment) (Value, error) {
+	if expr.Depth < 0 {
+		return env.globals().Get(expr.Name)
+	}
+	return env.GetAt(expr.Depth, expr.Slot), nil
 }
 
-func (expr Logical) Interpret(env *Environment) (BasicLit, error) {
+// The right side is only evaluated if the left side doesn't already decide the
+// result.
+func (expr Logical) Interpret(env *Environment) (Value, error) {
 	left, err := expr.Left.Interpret(env)
 	if err != nil {
-		return BasicLit{}, nil
-	}
-
-	right, err := expr.Right.Interpret(env)
-	if err != nil {
-		return BasicLit{}, nil
+		return left, err
 	}
 
 	if expr.Op.Type == _or {
@@ -254,7 +232,190 @@ func (expr Logical) Interpret(env *Environment) (BasicLit, error) {
 		return left, nil
 	}
 
-	return right, nil
+	return expr.Right.Interpret(env)
+}
+
+func (expr Call) Interpret(env *Environment) (Value, error) {
+	callee, err := expr.Callee.Interpret(env)
+	if err != nil {
+		return Nil, err
+	}
+
+	args := make([]Value, len(expr.Args))
+	for i, arg := range expr.Args {
+		if args[i], err = arg.Interpret(env); err != nil {
+			return Nil, err
+		}
+	}
+
+	if callee.Kind != funcLit && callee.Kind != classLit {
+		return Nil, errorAt(expr.Span, "Can only call functions and classes.")
+	}
+
+	fn := callee.ref.(Callable)
+	if fn.Arity() >= 0 && len(args) != fn.Arity() {
+		return Nil, errorAt(expr.Span, "Expected %d arguments but got %d.", fn.Arity(), len(args))
+	}
+
+	// Calls are limited to the same depth as the VM's frames, counting the
+	// top-level script as the first. Natives don't take up a frame.
+	g := env.globals()
+	_, isNative := fn.(*native)
+	if !isNative {
+		if g.calls == framesMax-1 {
+			return Nil, errorAt(expr.Span, "Stack overflow.")
+		}
+		g.calls++
+	}
+
+	result, err := fn.Call(env, args)
+
+	if !isNative {
+		g.calls--
+	}
+
+	if err != nil {
+		return Nil, callError(err, fn, expr.Span)
+	}
+	return result, nil
+}
+
+// Errors from natives are reported at the call. Errors from inside functions
+// already have a position, so the call is added to their stack trace instead.
+func callError(err error, fn Callable, call Span) error {
+	re, ok := err.(*runtimeError)
+	if !ok {
+		return withPos(err, call)
+	}
+
+	switch fn := fn.(type) {
+	case *function:
+		re.unwind(fn.decl.Name.name(), call.Line)
+	case *class:
+		re.unwind("init", call.Line)
+	}
+	return re
+}
+
+func (expr Get) Interpret(env *Environment) (Value, error) {
+	obj, err := expr.Object.Interpret(env)
+	if err != nil {
+		return Nil, err
+	}
+
+	if obj.Kind != instanceLit {
+		return Nil, lineError(expr.Name, "Only instances have properties.")
+	}
+
+	return obj.ref.(*instance).get(expr.Name)
+}
+
+func (expr Set) Interpret(env *Environment) (Value, error) {
+	obj, err := expr.Object.Interpret(env)
+	if err != nil {
+		return Nil, err
+	}
+
+	val, err := expr.Value.Interpret(env)
+	if err != nil {
+		return Nil, err
+	}
+
+	if obj.Kind != instanceLit {
+		return Nil, lineError(expr.Name, "Only instances have fields.")
+	}
+
+	obj.ref.(*instance).set(expr.Name, val)
+	return val, nil
+}
+
+func (expr This) Interpret(env *Environment) (Value, error) {
+	return env.GetAt(expr.Depth, 0), nil
+}
+
+// The Environment defining 'this' is always directly inside the one defining
+// 'super'. See ClassStmt.Execute and function.bind.
+func (expr Super) Interpret(env *Environment) (Value, error) {
+	superclass := env.GetAt(expr.Depth, 0).ref.(*class)
+	inst := env.GetAt(expr.Depth-1, 0).ref.(*instance)
+
+	method, has := superclass.findMethod(expr.Method.name())
+	if !has {
+		return Nil, lineError(expr.Method, "Undefined property '%s'.", expr.Method.name())
+	}
+
+	return funcValue(method.bind(inst)), nil
+}
+
+func (expr ListLit) Interpret(env *Environment) (Value, error) {
+	items := make([]Value, len(expr.Elements))
+
+	for i, el := range expr.Elements {
+		val, err := el.Interpret(env)
+		if err != nil {
+			return Nil, err
+		}
+		items[i] = val
+	}
+
+	return listValue(&list{items: items}), nil
+}
+
+func (expr MapLit) Interpret(env *Environment) (Value, error) {
+	d := newDict()
+
+	for i, k := range expr.Keys {
+		key, err := k.Interpret(env)
+		if err != nil {
+			return Nil, err
+		}
+
+		val, err := expr.Values[i].Interpret(env)
+		if err != nil {
+			return Nil, err
+		}
+
+		if err := checkKey(key, expr.Keys[i].SourceSpan()); err != nil {
+			return Nil, err
+		}
+
+		d.set(key, val)
+	}
+
+	return mapValue(d), nil
+}
+
+func (expr Index) Interpret(env *Environment) (Value, error) {
+	obj, err := expr.Object.Interpret(env)
+	if err != nil {
+		return Nil, err
+	}
+
+	idx, err := expr.Index.Interpret(env)
+	if err != nil {
+		return Nil, err
+	}
+
+	return indexGet(obj, idx, expr.Span)
+}
+
+func (expr SetIndex) Interpret(env *Environment) (Value, error) {
+	obj, err := expr.Object.Interpret(env)
+	if err != nil {
+		return Nil, err
+	}
+
+	idx, err := expr.Index.Interpret(env)
+	if err != nil {
+		return Nil, err
+	}
+
+	val, err := expr.Value.Interpret(env)
+	if err != nil {
+		return Nil, err
+	}
+
+	return val, indexSet(obj, idx, val, expr.Span)
 }
 
 // ----------------------------------------------------------------------------
@@ -263,75 +424,157 @@ func (expr Logical) Interpret(env *Environment) (BasicLit, error) {
 type (
 	Stmt interface {
 		Execute(io.Writer, *Environment) error
+		SourceSpan() Span
 	}
 
 	// Empty Stmt
-	NilStmt struct{}
+	NilStmt struct {
+		Span
+	}
 
 	ExprStmt struct {
+		Span
 		Expr Expr
+		Echo bool // print the value unless it's nil, for the REPL
 	}
 
 	PrintStmt struct {
+		Span
 		Expr Expr
 	}
 
 	VarStmt struct {
+		Span
 		Name Token
 		Expr Expr
 	}
 
 	AssignStmt struct {
+		Span
 		Name Token
 		Expr Expr
 	}
 
 	BlockStmt struct {
+		Span
 		Stmts []Stmt
 	}
 
 	IfStmt struct {
+		Span
 		Cond Expr
 		Then Stmt
 		Else Stmt
 	}
+
+	FunStmt struct {
+		Span
+		Name   Token
+		Params []Token
+		Body   []Stmt
+	}
+
+	// Superclass is nil if the class doesn't inherit.
+	ClassStmt struct {
+		Span
+		Name       Token
+		Superclass *Variable
+		Methods    []FunStmt
+	}
+
+	BreakStmt struct {
+		Span
+		Keyword Token
+	}
+
+	ContinueStmt struct {
+		Span
+		Keyword Token
+	}
+
+	// Value is nil for a bare 'return;'.
+	ReturnStmt struct {
+		Span
+		Keyword Token
+		Value   Expr
+	}
+
+	WhileStmt struct {
+		Span
+		Cond Expr
+		Body Stmt
+	}
+
+	// for (Vars[0] in Iterable) Body
+	// for (Vars[0], Vars[1] in Iterable) Body
+	// In is the 'in' keyword, used for reporting errors.
+	ForInStmt struct {
+		Span
+		Vars     []Token
+		In       Token
+		Iterable Expr
+		Body     Stmt
+	}
+
+	// for (Init; Cond; Incr) Body
+	// Init is a NilStmt and Incr is nil when the clause is omitted.
+	ForStmt struct {
+		Span
+		Init Stmt
+		Cond Expr
+		Incr Expr
+		Body Stmt
+	}
 )
 
 // ----------------------------------------------------------------------------
 // Executor methods
 
-func (stmt ExprStmt) Execute(_ io.Writer, env *Environment) error {
-	stmt.Expr.Interpret(env)
+func (stmt ExprStmt) Execute(w io.Writer, env *Environment) error {
+	val, err := stmt.Expr.Interpret(env)
+	if err != nil {
+		return err
+	}
+
+	if stmt.Echo && !val.IsNil() {
+		fmt.Fprintln(w, val)
+	}
 	return nil
 }
 
 func (stmt PrintStmt) Execute(w io.Writer, env *Environment) error {
-	lit, err := stmt.Expr.Interpret(env)
+	val, err := stmt.Expr.Interpret(env)
 	if err != nil {
 		return err
 	}
 
-	fmt.Fprintln(w, lit.Value)
+	fmt.Fprintln(w, val)
 	return nil
 }
 
 func (stmt VarStmt) Execute(_ io.Writer, env *Environment) error {
-	lit, err := stmt.Expr.Interpret(env)
+	// Variables declared without an initializer are nil.
+	if stmt.Expr == nil {
+		env.Define(stmt.Name.name(), Nil)
+		return nil
+	}
+
+	val, err := stmt.Expr.Interpret(env)
 	if err != nil {
 		return err
 	}
 
-	env.Define(string(stmt.Name.Lexeme), lit)
+	env.Define(stmt.Name.name(), val)
 	return nil
 }
 
 func (stmt AssignStmt) Execute(_ io.Writer, env *Environment) error {
-	lit, err := stmt.Expr.Interpret(env)
+	val, err := stmt.Expr.Interpret(env)
 	if err != nil {
 		return err
 	}
 
-	env.Assign(stmt.Name, lit)
+	env.Assign(stmt.Name, val)
 	return nil
 }
 
@@ -364,6 +607,189 @@ func (stmt IfStmt) Execute(w io.Writer, env *Environment) error {
 	return nil
 }
 
+func (stmt FunStmt) Execute(w io.Writer, env *Environment) error {
+	fn := &function{decl: stmt, closure: env, out: w}
+	env.Define(stmt.Name.name(), funcValue(fn))
+	return nil
+}
+
+// When the class has a superclass, methods are enclosed by an extra
+// Environment that defines 'super'.
+func (stmt ClassStmt) Execute(w io.Writer, env *Environment) error {
+	c := &class{
+		name:    stmt.Name.name(),
+		methods: make(map[string]*function),
+	}
+
+	closure := env
+	if stmt.Superclass != nil {
+		superclass, err := stmt.Superclass.Interpret(env)
+		if err != nil {
+			return err
+		}
+
+		if superclass.Kind != classLit {
+			return lineError(stmt.Superclass.Name, "Superclass must be a class.")
+		}
+
+		c.superclass = superclass.ref.(*class)
+		closure = NewEnvironment(false)
+		closure.Enclosing = env
+		closure.Define("super", superclass)
+	}
+
+	for _, method := range stmt.Methods {
+		name := method.Name.name()
+		c.methods[name] = &function{
+			decl:    method,
+			closure: closure,
+			out:     w,
+			isInit:  name == "init",
+		}
+	}
+
+	env.Define(c.name, classValue(c))
+	return nil
+}
+
+// Used by BreakStmt and ContinueStmt to unwind execution back to the enclosing
+// loop, the same way returnValue unwinds to the function call. The Parser only
+// allows them inside loops so they never reach Interpreter.Run.
+type (
+	breakSignal    struct{}
+	continueSignal struct{}
+)
+
+func (breakSignal) Error() string {
+	return "Can't use 'break' outside of a loop."
+}
+
+func (continueSignal) Error() string {
+	return "Can't use 'continue' outside of a loop."
+}
+
+// Checks the error returned by a loop body. done is true when the loop should
+// stop, and err is the error the loop should return.
+func loopSignal(bodyErr error) (done bool, err error) {
+	switch bodyErr.(type) {
+	case nil, continueSignal:
+		return false, nil
+	case breakSignal:
+		return true, nil
+	}
+	return true, bodyErr
+}
+
+func (BreakStmt) Execute(io.Writer, *Environment) error {
+	return breakSignal{}
+}
+
+func (ContinueStmt) Execute(io.Writer, *Environment) error {
+	return continueSignal{}
+}
+
+// Unwinds the stack back to the function call by returning a returnValue error.
+func (stmt ReturnStmt) Execute(_ io.Writer, env *Environment) error {
+	result := Nil
+
+	if stmt.Value != nil {
+		var err error
+		if result, err = stmt.Value.Interpret(env); err != nil {
+			return err
+		}
+	}
+
+	return returnValue{val: result}
+}
+
+func (stmt WhileStmt) Execute(w io.Writer, env *Environment) error {
+	for {
+		condLit, err := stmt.Cond.Interpret(env)
+		if err != nil {
+			return err
+		}
+
+		if !isTruthy(condLit) {
+			return nil
+		}
+
+		if done, err := loopSignal(stmt.Body.Execute(w, env)); done {
+			return err
+		}
+	}
+}
+
+// The initializer is executed in its own Environment so loop variables don't
+// leak into the enclosing scope.
+func (stmt ForStmt) Execute(w io.Writer, env *Environment) error {
+	local := NewEnvironment(false)
+	local.Enclosing = env
+
+	if err := stmt.Init.Execute(w, local); err != nil {
+		return err
+	}
+
+	for {
+		condLit, err := stmt.Cond.Interpret(local)
+		if err != nil {
+			return err
+		}
+
+		if !isTruthy(condLit) {
+			return nil
+		}
+
+		if done, err := loopSignal(stmt.Body.Execute(w, local)); done {
+			return err
+		}
+
+		if stmt.Incr != nil {
+			if _, err := stmt.Incr.Interpret(local); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// See iterate for the values given to the loop variables. Every iteration gets
+// a new Environment defining the loop variables. When the body is a block, its
+// statements run directly in that Environment rather than in another one
+// created by BlockStmt.Execute.
+func (stmt ForInStmt) Execute(w io.Writer, env *Environment) error {
+	iterable, err := stmt.Iterable.Interpret(env)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; ; {
+		key, val, next, ok, err := iterate(iterable, i, stmt.Iterable.SourceSpan())
+		if !ok {
+			return err
+		}
+		i = next
+
+		local := NewEnvironment(false)
+		local.Enclosing = env
+
+		if len(stmt.Vars) == 1 {
+			local.Define(stmt.Vars[0].name(), singleLoopVar(iterable, key, val))
+		} else {
+			local.Define(stmt.Vars[0].name(), key)
+			local.Define(stmt.Vars[1].name(), val)
+		}
+
+		if block, ok := stmt.Body.(BlockStmt); ok {
+			err = executeBlock(block.Stmts, w, local)
+		} else {
+			err = stmt.Body.Execute(w, local)
+		}
+
+		if done, err := loopSignal(err); done {
+			return err
+		}
+	}
+}
+
 func executeBlock(stmts []Stmt, w io.Writer, env *Environment) error {
 	for _, s := range stmts {
 		err := s.Execute(w, env)
@@ -0,0 +1,167 @@
+package deslang
+
+import (
+	"errors"
+	"fmt"
+	"unicode/utf8"
+)
+
+// Operators and other operations whose behavior doesn't depend on how the
+// program is being executed. The tree-walking interpreter and the VM both use
+// these so they always agree on results and error messages.
+
+func unaryOp(op tokentype, right Value) (Value, error) {
+	switch op {
+	case _bang:
+		return BoolValue(!isTruthy(right)), nil
+	case _minus:
+		if right.Kind != floatLit {
+			return Nil, errors.New("Operand must be a number.")
+		}
+		return NumberValue(-right.num), nil
+	}
+
+	return Nil, nil
+}
+
+func binaryOp(op tokentype, left, right Value) (Value, error) {
+	// Any two values can be compared for equality.
+	switch op {
+	case _bang_equal:
+		return BoolValue(!isEqual(left, right)), nil
+	case _equal_equal:
+		return BoolValue(isEqual(left, right)), nil
+	}
+
+	// Type check
+	if left.Kind != right.Kind {
+		err := fmt.Errorf(
+			"Invalid operation. Mismatched types %s and %s",
+			types[left.Kind],
+			types[right.Kind],
+		)
+		return Nil, err
+	}
+
+	if op == _plus && left.Kind == stringLit {
+		return StringValue(left.str + right.str), nil
+	}
+
+	if left.Kind != floatLit {
+		return Nil, errors.New("Operands must be numbers.")
+	}
+
+	switch op {
+	case _plus:
+		return NumberValue(left.num + right.num), nil
+	case _minus:
+		return NumberValue(left.num - right.num), nil
+	case _slash:
+		return NumberValue(left.num / right.num), nil
+	case _star:
+		return NumberValue(left.num * right.num), nil
+	case _greater:
+		return BoolValue(left.num > right.num), nil
+	case _greater_equal:
+		return BoolValue(left.num >= right.num), nil
+	case _less:
+		return BoolValue(left.num < right.num), nil
+	case _less_equal:
+		return BoolValue(left.num <= right.num), nil
+	}
+
+	return Nil, nil
+}
+
+// Lists, maps and strings can be indexed. Indexing a string returns a string
+// holding the single byte at that position. Missing map keys return nil.
+func indexGet(obj, idx Value, pos Span) (Value, error) {
+	switch obj.Kind {
+	case listLit:
+		l := obj.ref.(*list)
+		i, err := checkIndex(idx, len(l.items), pos)
+		if err != nil {
+			return Nil, err
+		}
+		return l.items[i], nil
+	case stringLit:
+		i, err := checkIndex(idx, len(obj.str), pos)
+		if err != nil {
+			return Nil, err
+		}
+		return StringValue(obj.str[i : i+1]), nil
+	case mapLit:
+		if err := checkKey(idx, pos); err != nil {
+			return Nil, err
+		}
+		val, _ := obj.ref.(*dict).get(idx)
+		return val, nil
+	}
+
+	return Nil, errorAt(pos, "Can't index a %s.", obj.Type())
+}
+
+func indexSet(obj, idx, val Value, pos Span) error {
+	switch obj.Kind {
+	case listLit:
+		l := obj.ref.(*list)
+		i, err := checkIndex(idx, len(l.items), pos)
+		if err != nil {
+			return err
+		}
+		l.items[i] = val
+		return nil
+	case mapLit:
+		if err := checkKey(idx, pos); err != nil {
+			return err
+		}
+		obj.ref.(*dict).set(idx, val)
+		return nil
+	}
+
+	return errorAt(pos, "Can't assign to an index of a %s.", obj.Type())
+}
+
+// Get the step of a for-in loop at position i, starting from 0, and the
+// position of the step after it. For lists key is the index and val is the
+// item. For maps key and val are the entry's key and value. Strings are
+// iterated a character at a time: key is the byte offset of the character, the
+// same as substr and indexing use, and val is the character. Bytes that aren't
+// valid UTF-8 are given one at a time. ok is false once there are no more
+// steps, or if iterable can't be iterated, in which case err is set. Checking
+// the length on every step means items added during the loop are visited.
+func iterate(iterable Value, i int, pos Span) (key, val Value, next int, ok bool, err error) {
+	switch iterable.Kind {
+	case listLit:
+		l := iterable.ref.(*list)
+		if i >= len(l.items) {
+			return Nil, Nil, i, false, nil
+		}
+		return NumberValue(float64(i)), l.items[i], i + 1, true, nil
+	case mapLit:
+		d := iterable.ref.(*dict)
+		if i >= len(d.keys) {
+			return Nil, Nil, i, false, nil
+		}
+		return d.keys[i], d.values[i], i + 1, true, nil
+	case stringLit:
+		s := iterable.str
+		if i >= len(s) {
+			return Nil, Nil, i, false, nil
+		}
+		_, size := utf8.DecodeRuneInString(s[i:])
+		return NumberValue(float64(i)), StringValue(s[i : i+size]), i + size, true, nil
+	}
+
+	err = errorAt(pos, "Can only iterate over lists, maps and strings, got %s.", iterable.Type())
+	return Nil, Nil, i, false, err
+}
+
+// Value of the loop variable when a for-in loop only has one. Maps give their
+// keys, everything else gives its items.
+func singleLoopVar(iterable, key, val Value) Value {
+	if iterable.Kind == mapLit {
+		return key
+	}
+	return val
+}
@@ -1,15 +1,23 @@
 package deslang
 
 import (
-	"reflect"
+	"strconv"
 )
 
+// Maximum number of parameters or arguments for a function.
+const maxArgs = 255
+
 // Parses tokens into nodes. Errors are sent to the ErrorReporter. Caller should
 // check for errors after parsing.
 type Parser struct {
-	errh    errorHandler // any errors during scanning
-	current int          // index of next token to be parsed
-	tokens  []Token
+	errh      errorHandler // any errors during scanning
+	current   int          // index of next token to be parsed
+	tokens    []Token
+	funDepth  int  // number of enclosing function bodies
+	loopDepth int  // number of enclosing loops within the current function
+	repl      bool // parsing REPL input, see Interpreter.SetREPL
+	errs      int  // number of errors reported
+	cutShort  bool // the first error was at the end of the tokens
 }
 
 func NewParser(errh errorHandler) *Parser {
@@ -19,6 +27,10 @@ func NewParser(errh errorHandler) *Parser {
 func (p *Parser) reset() {
 	p.tokens = []Token{}
 	p.current = 0
+	p.funDepth = 0
+	p.loopDepth = 0
+	p.errs = 0
+	p.cutShort = false
 }
 
 func (p *Parser) Parse(tokens []Token) []Stmt {
@@ -27,21 +39,58 @@ func (p *Parser) Parse(tokens []Token) []Stmt {
 	var stmts []Stmt
 
 	for !p.isAtEnd() {
-		stmts = append(stmts, p.decl())
+		stmt := p.decl()
+		if s, ok := stmt.(ExprStmt); ok && p.repl {
+			s.Echo = true
+			stmt = s
+		}
+		stmts = append(stmts, stmt)
 	}
 
 	return stmts
 }
 
 func (p *Parser) syntaxError(t Token, msg string) {
-	if t.Type == _eof {
-		p.errh(t.Line, "at end", msg)
-	} else {
-		p.errh(t.Line, "at '"+string(t.Lexeme)+"'", msg)
-	}
+	p.error(t, msg)
 	p.synchronize()
 }
 
+// Report an error at t without synchronizing, for mistakes that don't leave the
+// parser lost.
+func (p *Parser) error(t Token, msg string) {
+	p.report(t, tokenDiagnostic(SyntaxError, p.position(t), msg))
+}
+
+// Send d, an error found at t, to the errorHandler. Whether the input was cut
+// short is decided by the first error alone, since synchronizing after it can
+// run the Parser into the end.
+func (p *Parser) report(t Token, d Diagnostic) {
+	if p.errs == 0 {
+		p.cutShort = t.Type == _eof
+	}
+	p.errs++
+	p.errh(d)
+}
+
+// Errors at the end of input point just past the last token, since the end is
+// usually on an empty line after it.
+func (p *Parser) position(t Token) Token {
+	if t.Type == _eof && p.current > 0 {
+		last := p.previous()
+		t.Line = last.Line
+		t.Column = last.Column + last.End - last.Start
+		t.Start = last.End
+		t.End = last.End
+	}
+	return t
+}
+
+// The span from start to the end of the last token consumed.
+func (p *Parser) spanFrom(start Span) Span {
+	end := p.previous()
+	return Span{Start: start.Start, End: end.End, Line: start.Line, Column: start.Column}
+}
+
 // Discard tokens until a statement boundary is found. This is used for error
 // production. If an error is found during parsing, the Parser will try to parse
 // the remaining code after this synchronization point.
@@ -54,7 +103,7 @@ func (p *Parser) synchronize() {
 		}
 
 		switch p.peek().Type {
-		case _fun, _var, _for, _if, _while, _print, _return:
+		case _class, _fun, _var, _for, _if, _while, _print, _return, _break, _continue:
 			return
 		}
 
@@ -111,13 +160,93 @@ func (p *Parser) consume(tt tokentype, msg string) Token {
 }
 
 func (p *Parser) decl() Stmt {
+	if p.match(_class) {
+		return p.classDecl()
+	}
+	if p.match(_fun) {
+		return p.funDecl("function")
+	}
 	if p.match(_var) {
 		return p.varDecl()
 	}
 	return p.stmt()
 }
 
+func (p *Parser) classDecl() Stmt {
+	keyword := p.previous()
+	name := p.consume(_identifier, "Expect class name.")
+
+	var superclass *Variable
+	if p.match(_less) {
+		p.consume(_identifier, "Expect superclass name.")
+		superclass = &Variable{Span: p.previous().span(), Name: p.previous(), Depth: -1}
+	}
+
+	p.consume(_left_brace, "Expect '{' before class body.")
+
+	var methods []FunStmt
+	for !p.check(_right_brace) && !p.isAtEnd() {
+		if method, ok := p.funDecl("method").(FunStmt); ok {
+			methods = append(methods, method)
+		}
+	}
+
+	p.consume(_right_brace, "Expect '}' after class body.")
+
+	return ClassStmt{
+		Span:       p.spanFrom(keyword.span()),
+		Name:       name,
+		Superclass: superclass,
+		Methods:    methods,
+	}
+}
+
+func (p *Parser) funDecl(kind string) Stmt {
+	// Functions start at 'fun', methods at their name.
+	start := p.peek()
+	if kind == "function" {
+		start = p.previous()
+	}
+
+	name := p.consume(_identifier, "Expect "+kind+" name.")
+	p.consume(_left_paren, "Expect '(' after "+kind+" name.")
+
+	var params []Token
+	if !p.check(_right_paren) {
+		for {
+			if len(params) >= maxArgs {
+				p.error(p.peek(), "Can't have more than 255 parameters.")
+			}
+
+			params = append(params, p.consume(_identifier, "Expect parameter name."))
+
+			if !p.match(_comma) {
+				break
+			}
+		}
+	}
+
+	p.consume(_right_paren, "Expect ')' after parameters.")
+	p.consume(_left_brace, "Expect '{' before "+kind+" body.")
+
+	// Loops outside the function can't be broken out of from inside it.
+	enclosingLoops := p.loopDepth
+	p.loopDepth = 0
+	p.funDepth++
+	body := p.block()
+	p.funDepth--
+	p.loopDepth = enclosingLoops
+
+	return FunStmt{
+		Span:   p.spanFrom(start.span()),
+		Name:   name,
+		Params: params,
+		Body:   body,
+	}
+}
+
 func (p *Parser) varDecl() Stmt {
+	keyword := p.previous()
 	var expr Expr
 	name := p.consume(_identifier, "Expect variable name.")
 
@@ -126,7 +255,7 @@ func (p *Parser) varDecl() Stmt {
 	}
 
 	p.consume(_semicolon, "Expect ';' after variable declaration.")
-	return VarStmt{Name: name, Expr: expr}
+	return VarStmt{Span: p.spanFrom(keyword.span()), Name: name, Expr: expr}
 }
 
 func (p *Parser) stmt() Stmt {
@@ -138,20 +267,57 @@ func (p *Parser) stmt() Stmt {
 		return p.printStmt()
 	}
 
-	if p.match(_left_brace) {
-		return BlockStmt{Stmts: p.block()}
+	if p.match(_while) {
+		return p.whileStmt()
+	}
+
+	if p.match(_for) {
+		return p.forStmt()
+	}
+
+	if p.match(_return) {
+		return p.returnStmt()
+	}
+
+	if p.match(_break, _continue) {
+		return p.loopJumpStmt()
+	}
+
+	// A brace at the start of a statement is a block unless it's clearly the
+	// start of a map literal.
+	if p.check(_left_brace) && !p.mapAhead() {
+		brace := p.advance()
+		return BlockStmt{Stmts: p.block(), Span: p.spanFrom(brace.span())}
 	}
 
 	return p.exprStmt()
 }
 
+// Reports whether the tokens starting at the current '{' look like a map
+// literal, i.e. '{' followed by a string or number key and a ':'.
+func (p *Parser) mapAhead() bool {
+	if p.current+2 >= len(p.tokens) {
+		return false
+	}
+
+	key := p.tokens[p.current+1].Type
+	return (key == _string || key == _number) && p.tokens[p.current+2].Type == _colon
+}
+
 func (p *Parser) exprStmt() Stmt {
 	expr := p.expression()
+
+	// The REPL doesn't need a ';' after an expression typed on its own.
+	if p.repl && p.isAtEnd() {
+		return ExprStmt{Span: p.spanFrom(expr.SourceSpan()), Expr: expr}
+	}
+
 	p.consume(_semicolon, "Expect ';' after value.")
-	return ExprStmt{Expr: expr}
+	return ExprStmt{Span: p.spanFrom(expr.SourceSpan()), Expr: expr}
 }
 
 func (p *Parser) ifStmt() Stmt {
+	keyword := p.previous()
 	p.consume(_left_paren, "Expect '(' after 'if'.")
 	expr := p.expression()
 	p.consume(_right_paren, "Expect ')' after if condition.")
@@ -166,22 +332,156 @@ func (p *Parser) ifStmt() Stmt {
 	}
 
 	return IfStmt{
+		Span: p.spanFrom(keyword.span()),
 		Cond: expr,
 		Then: thenBranch,
 		Else: elseBranch,
 	}
 }
 
+// Parse the body of a loop, where break and continue are allowed.
+func (p *Parser) loopBody() Stmt {
+	p.loopDepth++
+	body := p.stmt()
+	p.loopDepth--
+	return body
+}
+
+// break or continue
+func (p *Parser) loopJumpStmt() Stmt {
+	keyword := p.previous()
+
+	if p.loopDepth == 0 {
+		p.error(keyword, "Can't use '"+string(keyword.Lexeme)+"' outside of a loop.")
+	}
+
+	p.consume(_semicolon, "Expect ';' after '"+string(keyword.Lexeme)+"'.")
+
+	if keyword.Type == _break {
+		return BreakStmt{Span: p.spanFrom(keyword.span()), Keyword: keyword}
+	}
+	return ContinueStmt{Span: p.spanFrom(keyword.span()), Keyword: keyword}
+}
+
+func (p *Parser) whileStmt() Stmt {
+	keyword := p.previous()
+	p.consume(_left_paren, "Expect '(' after 'while'.")
+	cond := p.expression()
+	p.consume(_right_paren, "Expect ')' after condition.")
+	body := p.loopBody()
+
+	return WhileStmt{
+		Span: p.spanFrom(keyword.span()),
+		Cond: cond,
+		Body: body,
+	}
+}
+
+func (p *Parser) forStmt() Stmt {
+	keyword := p.previous()
+	p.consume(_left_paren, "Expect '(' after 'for'.")
+
+	if p.forInAhead() {
+		return p.forInStmt(keyword)
+	}
+
+	var init Stmt
+	switch {
+	case p.match(_semicolon):
+		init = NilStmt{}
+	case p.match(_var):
+		init = p.varDecl()
+	default:
+		init = p.exprStmt()
+	}
+
+	// An omitted condition loops forever.
+	var cond Expr = BasicLit{Value: BoolValue(true)}
+	if !p.check(_semicolon) {
+		cond = p.expression()
+	}
+	p.consume(_semicolon, "Expect ';' after loop condition.")
+
+	var incr Expr
+	if !p.check(_right_paren) {
+		incr = p.expression()
+	}
+	p.consume(_right_paren, "Expect ')' after for clauses.")
+	body := p.loopBody()
+
+	return ForStmt{
+		Span: p.spanFrom(keyword.span()),
+		Init: init,
+		Cond: cond,
+		Incr: incr,
+		Body: body,
+	}
+}
+
+func (p *Parser) returnStmt() Stmt {
+	keyword := p.previous()
+
+	if p.funDepth == 0 {
+		p.error(keyword, "Can't return from top-level code.")
+	}
+
+	var val Expr
+	if !p.check(_semicolon) {
+		val = p.expression()
+	}
+
+	p.consume(_semicolon, "Expect ';' after return value.")
+	return ReturnStmt{Span: p.spanFrom(keyword.span()), Keyword: keyword, Value: val}
+}
+
+// Reports whether the tokens after 'for (' are 'x in' or 'x, y in'.
+func (p *Parser) forInAhead() bool {
+	lookahead := func(n int) tokentype {
+		if p.current+n >= len(p.tokens) {
+			return _eof
+		}
+		return p.tokens[p.current+n].Type
+	}
+
+	if lookahead(0) != _identifier {
+		return false
+	}
+
+	return lookahead(1) == _in ||
+		(lookahead(1) == _comma && lookahead(2) == _identifier && lookahead(3) == _in)
+}
+
+func (p *Parser) forInStmt(keyword Token) Stmt {
+	vars := []Token{p.advance()}
+	if p.match(_comma) {
+		vars = append(vars, p.advance())
+	}
+
+	in := p.consume(_in, "Expect 'in' after loop variables.")
+	iterable := p.expression()
+	p.consume(_right_paren, "Expect ')' after for-in clause.")
+	body := p.loopBody()
+
+	return ForInStmt{
+		Span:     p.spanFrom(keyword.span()),
+		Vars:     vars,
+		In:       in,
+		Iterable: iterable,
+		Body:     body,
+	}
+}
+
 func (p *Parser) printStmt() Stmt {
+	keyword := p.previous()
 	val := p.expression()
 	p.consume(_semicolon, "Expect ';' after value.")
-	return PrintStmt{Expr: val}
+	return PrintStmt{Span: p.spanFrom(keyword.span()), Expr: val}
 }
 
 func (p *Parser) block() []Stmt {
 	var stmts []Stmt
 
-	for !p.check(_right_brace) {
+	for !p.check(_right_brace) && !p.isAtEnd() {
 		stmts = append(stmts, p.decl())
 	}
 
@@ -191,34 +491,98 @@ func (p *Parser) block() []Stmt {
 
 func (p *Parser) primary() Expr {
 	if p.match(_false) {
-		return BasicLit{Value: "false", Kind: boolLit}
+		return BasicLit{Span: p.previous().span(), Value: BoolValue(false)}
 	}
 
 	if p.match(_true) {
-		return BasicLit{Value: "true", Kind: boolLit}
+		return BasicLit{Span: p.previous().span(), Value: BoolValue(true)}
+	}
+
+	if p.match(_nil) {
+		return BasicLit{Span: p.previous().span(), Value: Nil}
 	}
 
 	if p.match(_number) {
-		return BasicLit{Value: string(p.previous().Literal), Kind: floatLit}
+		// The Scanner only produces valid numbers so the error can be ignored.
+		f, _ := strconv.ParseFloat(string(p.previous().Literal), 64)
+		return BasicLit{Span: p.previous().span(), Value: NumberValue(f)}
 	}
 
 	if p.match(_string) {
-		return BasicLit{Value: string(p.previous().Literal), Kind: stringLit}
+		return BasicLit{Span: p.previous().span(), Value: StringValue(p.previous().str)}
+	}
+
+	if p.match(_super) {
+		keyword := p.previous()
+		p.consume(_dot, "Expect '.' after 'super'.")
+		method := p.consume(_identifier, "Expect superclass method name.")
+		return &Super{Span: p.spanFrom(keyword.span()), Keyword: keyword, Method: method, Depth: -1}
+	}
+
+	if p.match(_this) {
+		return &This{Span: p.previous().span(), Keyword: p.previous(), Depth: -1}
 	}
 
 	if p.match(_identifier) {
-		return Variable{Name: p.previous()}
+		return &Variable{Span: p.previous().span(), Name: p.previous(), Depth: -1}
 	}
 
 	if p.match(_left_paren) {
+		paren := p.previous()
 		expr := p.expression()
 		p.consume(_right_paren, "Expect ')' after expression.")
-		return Grouping{X: expr}
+		return Grouping{Span: p.spanFrom(paren.span()), X: expr}
+	}
+
+	if p.match(_left_bracket) {
+		return p.listLit()
+	}
+
+	if p.match(_left_brace) {
+		return p.mapLit()
 	}
 
-	p.errh(p.peek().Line, "", "Expected expression")
+	p.error(p.peek(), "Expected expression")
+
+	return BasicLit{Value: Nil}
+}
+
+func (p *Parser) listLit() Expr {
+	bracket := p.previous()
+	var elements []Expr
+
+	if !p.check(_right_bracket) {
+		for {
+			elements = append(elements, p.expression())
 
-	return BasicLit{Value: "", Kind: nilLit}
+			if !p.match(_comma) {
+				break
+			}
+		}
+	}
+
+	p.consume(_right_bracket, "Expect ']' after list elements.")
+	return ListLit{Span: p.spanFrom(bracket.span()), Elements: elements}
+}
+
+func (p *Parser) mapLit() Expr {
+	m := MapLit{Brace: p.previous()}
+
+	if !p.check(_right_brace) {
+		for {
+			m.Keys = append(m.Keys, p.expression())
+			p.consume(_colon, "Expect ':' after map key.")
+			m.Values = append(m.Values, p.expression())
+
+			if !p.match(_comma) {
+				break
+			}
+		}
+	}
+
+	p.consume(_right_brace, "Expect '}' after map entries.")
+	m.Span = p.spanFrom(m.Brace.span())
+	return m
 }
 
 func (p *Parser) unary() Expr {
@@ -227,12 +591,62 @@ func (p *Parser) unary() Expr {
 		right := p.unary()
 
 		return Unary{
+			Span:  p.spanFrom(op.span()),
 			Op:    op,
 			Right: right,
 		}
 	}
 
-	return p.primary()
+	return p.call()
+}
+
+func (p *Parser) call() Expr {
+	expr := p.primary()
+
+	for {
+		if p.match(_left_paren) {
+			expr = p.finishCall(expr)
+		} else if p.match(_left_bracket) {
+			bracket := p.previous()
+			idx := p.expression()
+			p.consume(_right_bracket, "Expect ']' after index.")
+			expr = Index{Span: p.spanFrom(expr.SourceSpan()), Object: expr, Bracket: bracket, Index: idx}
+		} else if p.match(_dot) {
+			name := p.consume(_identifier, "Expect property name after '.'.")
+			expr = Get{Span: p.spanFrom(expr.SourceSpan()), Object: expr, Name: name}
+		} else {
+			break
+		}
+	}
+
+	return expr
+}
+
+func (p *Parser) finishCall(callee Expr) Expr {
+	var args []Expr
+
+	if !p.check(_right_paren) {
+		for {
+			if len(args) >= maxArgs {
+				p.error(p.peek(), "Can't have more than 255 arguments.")
+			}
+
+			args = append(args, p.expression())
+
+			if !p.match(_comma) {
+				break
+			}
+		}
+	}
+
+	paren := p.consume(_right_paren, "Expect ')' after arguments.")
+
+	return Call{
+		Span:   p.spanFrom(callee.SourceSpan()),
+		Callee: callee,
+		Paren:  paren,
+		Args:   args,
+	}
 }
 
 func (p *Parser) factor() Expr {
@@ -243,6 +657,7 @@ func (p *Parser) factor() Expr {
 		right := p.unary()
 
 		expr = Binary{
+			Span:  p.spanFrom(expr.SourceSpan()),
 			Left:  expr,
 			Right: right,
 			Op:    op,
@@ -260,6 +675,7 @@ func (p *Parser) term() Expr {
 		right := p.factor()
 
 		expr = Binary{
+			Span:  p.spanFrom(expr.SourceSpan()),
 			Left:  expr,
 			Right: right,
 			Op:    op,
@@ -277,6 +693,7 @@ func (p *Parser) comparison() Expr {
 		right := p.term()
 
 		expr = Binary{
+			Span:  p.spanFrom(expr.SourceSpan()),
 			Left:  expr,
 			Right: right,
 			Op:    op,
@@ -298,6 +715,7 @@ func (p *Parser) equality() Expr {
 		rightExpr := p.comparison()
 
 		expr = Binary{
+			Span:  p.spanFrom(expr.SourceSpan()),
 			Left:  expr,
 			Right: rightExpr,
 			Op:    op,
@@ -315,6 +733,7 @@ func (p *Parser) and() Expr {
 		right := p.equality()
 
 		expr = Logical{
+			Span:  p.spanFrom(expr.SourceSpan()),
 			Left:  expr,
 			Right: right,
 			Op:    op,
@@ -332,6 +751,7 @@ func (p *Parser) or() Expr {
 		right := p.and()
 
 		expr = Logical{
+			Span:  p.spanFrom(expr.SourceSpan()),
 			Left:  expr,
 			Right: right,
 			Op:    op,
@@ -348,16 +768,32 @@ func (p *Parser) assignment() Expr {
 		equals := p.previous()
 		val := p.assignment()
 
-		// check if left expr is Variable
-		f := reflect.ValueOf(expr).FieldByName("Name")
-		if f.IsValid() {
-			return Assign{
-				Name:  f.Interface().(Token),
+		switch target := expr.(type) {
+		case *Variable:
+			return &Assign{
+				Span:  p.spanFrom(expr.SourceSpan()),
+				Name:  target.Name,
 				Value: val,
+				Depth: -1,
+			}
+		case Get:
+			return Set{
+				Span:   p.spanFrom(expr.SourceSpan()),
+				Object: target.Object,
+				Name:   target.Name,
+				Value:  val,
+			}
+		case Index:
+			return SetIndex{
+				Span:    p.spanFrom(expr.SourceSpan()),
+				Object:  target.Object,
+				Bracket: target.Bracket,
+				Index:   target.Index,
+				Value:   val,
 			}
 		}
 
-		p.errh(equals.Line, "", "Invalid assignment target.")
+		p.error(equals, "Invalid assignment target.")
 	}
 
 	return expr
@@ -0,0 +1,299 @@
+package deslang
+
+// Walks the parsed statements before they're executed and figures out which
+// scope every variable refers to. The distance and slot are stored on each
+// Variable and Assign node so the Environment lookup can go directly to the
+// right scope and index into it.
+// This way a closure keeps referring to the variable it saw when it was
+// declared even if a variable with the same name is declared later.
+//
+// Mistakes that can be caught before running, like redeclaring a variable in
+// the same scope, are reported to the errorHandler.
+type Resolver struct {
+	errh   errorHandler
+	scopes []map[string]localVar // local scopes; the global scope isn't tracked
+	fun    funKind               // kind of function being resolved
+	class  classKind             // kind of class being resolved
+}
+
+// A variable declared in a local scope. Slots are given out in declaration
+// order, matching the order the variables are defined in the Environment at
+// runtime.
+type localVar struct {
+	slot    int
+	defined bool
+}
+
+type funKind int
+
+const (
+	noFun funKind = iota
+	plainFun
+	methodFun
+	initFun
+)
+
+type classKind int
+
+const (
+	noClass classKind = iota
+	plainClass
+	subClass
+)
+
+func NewResolver(errh errorHandler) *Resolver {
+	return &Resolver{errh: errh}
+}
+
+func (r *Resolver) Resolve(stmts []Stmt) {
+	r.scopes = nil
+	r.fun = noFun
+	r.class = noClass
+	r.stmts(stmts)
+}
+
+func (r *Resolver) beginScope() {
+	r.scopes = append(r.scopes, map[string]localVar{})
+}
+
+func (r *Resolver) endScope() {
+	r.scopes = r.scopes[:len(r.scopes)-1]
+}
+
+func (r *Resolver) error(t Token, msg string) {
+	r.errh(tokenDiagnostic(ResolveError, t, msg))
+}
+
+// A declared variable exists in the scope but can't be used until it's
+// defined. This catches reading a variable in its own initializer.
+func (r *Resolver) declare(name Token) {
+	if len(r.scopes) == 0 {
+		return
+	}
+
+	scope := r.scopes[len(r.scopes)-1]
+	if _, has := scope[name.name()]; has {
+		r.error(name, "Already a variable with this name in this scope.")
+		return
+	}
+
+	scope[name.name()] = localVar{slot: len(scope)}
+}
+
+func (r *Resolver) define(name Token) {
+	if len(r.scopes) == 0 {
+		return
+	}
+
+	scope := r.scopes[len(r.scopes)-1]
+	v := scope[name.name()]
+	v.defined = true
+	scope[name.name()] = v
+}
+
+// Distance to the innermost scope declaring name and its slot there, or -1 if it
+// must be global.
+func (r *Resolver) local(name Token) (depth int, slot int) {
+	for i := len(r.scopes) - 1; i >= 0; i-- {
+		if v, has := r.scopes[i][name.name()]; has {
+			return len(r.scopes) - 1 - i, v.slot
+		}
+	}
+	return -1, -1
+}
+
+func (r *Resolver) stmts(stmts []Stmt) {
+	for _, s := range stmts {
+		r.stmt(s)
+	}
+}
+
+func (r *Resolver) stmt(stmt Stmt) {
+	switch s := stmt.(type) {
+	case BlockStmt:
+		r.beginScope()
+		r.stmts(s.Stmts)
+		r.endScope()
+	case VarStmt:
+		r.declare(s.Name)
+		if s.Expr != nil {
+			r.expr(s.Expr)
+		}
+		r.define(s.Name)
+	case FunStmt:
+		// Define the name first so the function can refer to itself.
+		r.declare(s.Name)
+		r.define(s.Name)
+		r.function(s, plainFun)
+	case ClassStmt:
+		r.declare(s.Name)
+		r.define(s.Name)
+		r.classBody(s)
+	case ExprStmt:
+		r.expr(s.Expr)
+	case PrintStmt:
+		r.expr(s.Expr)
+	case ReturnStmt:
+		if s.Value != nil {
+			if r.fun == initFun {
+				r.error(s.Keyword, "Can't return a value from an initializer.")
+			}
+			r.expr(s.Value)
+		}
+	case IfStmt:
+		r.expr(s.Cond)
+		r.stmt(s.Then)
+		r.stmt(s.Else)
+	case WhileStmt:
+		r.expr(s.Cond)
+		r.stmt(s.Body)
+	case ForInStmt:
+		// Matches the Environment ForInStmt.Execute creates for each iteration,
+		// which a block body shares.
+		r.expr(s.Iterable)
+		r.beginScope()
+		for _, v := range s.Vars {
+			r.declare(v)
+			r.define(v)
+		}
+		if block, ok := s.Body.(BlockStmt); ok {
+			r.stmts(block.Stmts)
+		} else {
+			r.stmt(s.Body)
+		}
+		r.endScope()
+	case ForStmt:
+		// Matches the Environment ForStmt.Execute creates for the initializer.
+		r.beginScope()
+		r.stmt(s.Init)
+		r.expr(s.Cond)
+		if s.Incr != nil {
+			r.expr(s.Incr)
+		}
+		r.stmt(s.Body)
+		r.endScope()
+	}
+}
+
+// Parameters and the body share a single scope, the same as function.Call.
+func (r *Resolver) function(fn FunStmt, kind funKind) {
+	enclosing := r.fun
+	r.fun = kind
+
+	r.beginScope()
+	for _, param := range fn.Params {
+		r.declare(param)
+		r.define(param)
+	}
+	r.stmts(fn.Body)
+	r.endScope()
+
+	r.fun = enclosing
+}
+
+// Methods are resolved inside an extra scope holding 'this', matching the
+// Environment created by function.bind. Subclasses have another scope holding
+// 'super' around that, matching the Environment created by ClassStmt.Execute.
+func (r *Resolver) classBody(c ClassStmt) {
+	enclosing := r.class
+	r.class = plainClass
+
+	if c.Superclass != nil {
+		if c.Superclass.Name.name() == c.Name.name() {
+			r.error(c.Superclass.Name, "A class can't inherit from itself.")
+		}
+
+		r.class = subClass
+		r.expr(c.Superclass)
+
+		r.beginScope()
+		r.scopes[len(r.scopes)-1]["super"] = localVar{slot: 0, defined: true}
+	}
+
+	r.beginScope()
+	r.scopes[len(r.scopes)-1]["this"] = localVar{slot: 0, defined: true}
+
+	for _, method := range c.Methods {
+		kind := methodFun
+		if method.Name.name() == "init" {
+			kind = initFun
+		}
+		r.function(method, kind)
+	}
+
+	r.endScope()
+
+	if c.Superclass != nil {
+		r.endScope()
+	}
+
+	r.class = enclosing
+}
+
+func (r *Resolver) expr(expr Expr) {
+	switch e := expr.(type) {
+	case *Variable:
+		if len(r.scopes) > 0 {
+			v, has := r.scopes[len(r.scopes)-1][e.Name.name()]
+			if has && !v.defined {
+				r.error(e.Name, "Can't read local variable in its own initializer.")
+			}
+		}
+		e.Depth, e.Slot = r.local(e.Name)
+	case *Assign:
+		r.expr(e.Value)
+		e.Depth, e.Slot = r.local(e.Name)
+	case Unary:
+		r.expr(e.Right)
+	case Binary:
+		r.expr(e.Left)
+		r.expr(e.Right)
+	case Logical:
+		r.expr(e.Left)
+		r.expr(e.Right)
+	case Grouping:
+		r.expr(e.X)
+	case Call:
+		r.expr(e.Callee)
+		for _, arg := range e.Args {
+			r.expr(arg)
+		}
+	case ListLit:
+		for _, el := range e.Elements {
+			r.expr(el)
+		}
+	case MapLit:
+		for i, k := range e.Keys {
+			r.expr(k)
+			r.expr(e.Values[i])
+		}
+	case Index:
+		r.expr(e.Object)
+		r.expr(e.Index)
+	case SetIndex:
+		r.expr(e.Object)
+		r.expr(e.Index)
+		r.expr(e.Value)
+	case Get:
+		r.expr(e.Object)
+	case Set:
+		r.expr(e.Value)
+		r.expr(e.Object)
+	case *This:
+		if r.class == noClass {
+			r.error(e.Keyword, "Can't use 'this' outside of a class.")
+			return
+		}
+		e.Depth, _ = r.local(e.Keyword)
+	case *Super:
+		switch r.class {
+		case noClass:
+			r.error(e.Keyword, "Can't use 'super' outside of a class.")
+			return
+		case plainClass:
+			r.error(e.Keyword, "Can't use 'super' in a class with no superclass.")
+			return
+		}
+		e.Depth, _ = r.local(e.Keyword)
+	}
+}
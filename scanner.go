@@ -15,21 +15,55 @@ type Scanner struct {
 	currLex []byte        // partial lexeme
 	line    int           // current line
 	ch      byte          // most recently read character
+	names   interner      // identifiers seen by the current call to Scan
+	src     []byte        // everything read from the source so far
+	open    bool          // the source ended inside a string
+
+	offset    int // offset of the next byte
+	lineStart int // offset of the first byte on the current line
+	start     int // offset of the current lexeme
+	startLine int // line of the current lexeme
+	startCol  int // column of the current lexeme
+}
+
+// Deduplicates identifiers so every occurrence of the same name in a source
+// shares one copy. Looking up a []byte key doesn't allocate, so interning is
+// also a cheap way to turn a lexeme into a string. A new table is made for
+// every call to Scan, so a long-running REPL doesn't keep every name ever typed
+// into it. String literals and strings made at runtime, e.g. by concatenation,
+// aren't interned since each is usually unique and the table would only grow.
+type interner map[string]string
+
+func (in interner) intern(b []byte) string {
+	if s, has := in[string(b)]; has {
+		return s
+	}
+
+	s := string(b)
+	in[s] = s
+	return s
 }
 
 var keywords = map[string]tokentype{
-	"and":    _and,
-	"else":   _else,
-	"false":  _false,
-	"for":    _for,
-	"fun":    _fun,
-	"if":     _if,
-	"or":     _or,
-	"print":  _print,
-	"return": _return,
-	"true":   _true,
-	"var":    _var,
-	"while":  _while,
+	"and":      _and,
+	"break":    _break,
+	"class":    _class,
+	"continue": _continue,
+	"else":     _else,
+	"false":    _false,
+	"for":      _for,
+	"fun":      _fun,
+	"if":       _if,
+	"in":       _in,
+	"nil":      _nil,
+	"or":       _or,
+	"print":    _print,
+	"return":   _return,
+	"super":    _super,
+	"this":     _this,
+	"true":     _true,
+	"var":      _var,
+	"while":    _while,
 }
 
 func NewScanner(errh errorHandler) *Scanner {
@@ -41,7 +75,30 @@ func NewScanner(errh errorHandler) *Scanner {
 
 func (s *Scanner) reset() {
 	s.tokens = []Token{}
+	s.src = s.src[:0]
 	s.line = 1
+	s.offset = 0
+	s.lineStart = 0
+	s.open = false
+	s.names = make(interner)
+}
+
+// The text of the given line of the source most recently scanned, without the
+// line break.
+func (s *Scanner) sourceLine(line int) string {
+	text := s.src
+	for ; line > 1; line-- {
+		i := bytes.IndexByte(text, '\n')
+		if i < 0 {
+			return ""
+		}
+		text = text[i+1:]
+	}
+
+	if i := bytes.IndexByte(text, '\n'); i >= 0 {
+		text = text[:i]
+	}
+	return string(bytes.TrimSuffix(text, []byte("\r")))
 }
 
 // If reading the next byte fails, Scan will return an error. All syntax errors
@@ -52,6 +109,9 @@ func (s *Scanner) Scan(src io.Reader) ([]Token, error) {
 
 	for {
 		s.currLex = []byte{}
+		s.start = s.offset
+		s.startLine = s.line
+		s.startCol = s.offset - s.lineStart + 1
 
 		if err := s.next(); err != nil {
 			if err == io.EOF {
@@ -69,14 +129,24 @@ func (s *Scanner) addToken(ttype tokentype, lit []byte) {
 		Type:    ttype,
 		Lexeme:  s.currLex,
 		Literal: lit,
-		Line:    s.line,
+		Line:    s.startLine,
+		Column:  s.startCol,
+		Start:   s.start,
+		End:     s.offset,
+	}
+
+	switch ttype {
+	case _identifier:
+		t.str = s.names.intern(t.Lexeme)
+	case _string:
+		t.str = string(t.Literal)
 	}
 
 	s.tokens = append(s.tokens, t)
 }
 
 // Read the next character and store the byte in s.ch. Append the character to
-// s.currLex.
+// s.currLex. Line breaks are counted here so ones inside strings aren't missed.
 func (s *Scanner) next() error {
 	b, err := s.source.ReadByte()
 	if err != nil {
@@ -85,12 +155,39 @@ func (s *Scanner) next() error {
 
 	s.ch = b
 	s.currLex = append(s.currLex, s.ch)
+	s.src = append(s.src, s.ch)
+
+	s.offset++
+	if b == '\n' {
+		s.line++
+		s.lineStart = s.offset
+	}
 
 	return nil
 }
 
+// Report an error at the current lexeme. Only its first line is underlined.
+func (s *Scanner) error(msg string) {
+	length := s.offset - s.start
+	if i := bytes.IndexByte(s.currLex, '\n'); i >= 0 {
+		length = i
+	}
+
+	s.errh(Diagnostic{
+		Kind:    SyntaxError,
+		Line:    s.startLine,
+		Column:  s.startCol,
+		Length:  length,
+		Message: msg,
+	})
+}
+
+// The next character without consuming it, or 0 at the end of the source.
 func (s *Scanner) peek() byte {
 	b, _ := s.source.Peek(1)
+	if len(b) == 0 {
+		return 0
+	}
 	return b[0]
 }
 
@@ -111,7 +208,8 @@ func (s *Scanner) string() {
 
 	for s.ch != '"' {
 		if err := s.next(); err == io.EOF {
-			s.errh(s.line, "", "Unterminated string")
+			s.open = true
+			s.error("Unterminated string")
 			return
 		}
 	}
@@ -168,8 +266,16 @@ func (s *Scanner) parseCh() {
 		s.addToken(_left_brace, nil)
 	case '}':
 		s.addToken(_right_brace, nil)
+	case '[':
+		s.addToken(_left_bracket, nil)
+	case ']':
+		s.addToken(_right_bracket, nil)
+	case ':':
+		s.addToken(_colon, nil)
 	case ',':
 		s.addToken(_comma, nil)
+	case '.':
+		s.addToken(_dot, nil)
 	case '-':
 		s.addToken(_minus, nil)
 	case '+':
@@ -214,10 +320,8 @@ func (s *Scanner) parseCh() {
 		} else {
 			s.addToken(_slash, nil)
 		}
-	case ' ', '\r', '\t':
+	case ' ', '\r', '\t', '\n':
 		return
-	case '\n':
-		s.line++
 	case '"':
 		s.string()
 	case '1', '2', '3', '4', '5', '6', '7', '8', '9', '0':
@@ -226,7 +330,7 @@ func (s *Scanner) parseCh() {
 		if unicode.IsLetter(rune(s.ch)) {
 			s.identifier()
 		} else {
-			s.errh(s.line, "", "Unexpected character")
+			s.error("Unexpected character")
 		}
 	}
 }
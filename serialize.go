@@ -0,0 +1,267 @@
+package deslang
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math"
+)
+
+// Compiled programs are stored in .dlc files with this layout:
+//
+//	magic    4 bytes  "DLC\x00"
+//	version  2 bytes  bytecodeVersion, big-endian
+//	length   4 bytes  length of the payload, big-endian
+//	checksum 4 bytes  CRC-32 (IEEE) of the payload, big-endian
+//	payload           the top-level function, see encoder.function
+//
+// bytecodeVersion must be bumped whenever the instruction set or the payload
+// encoding changes, so files built by an older deslang are rejected instead of
+// misinterpreted.
+const bytecodeVersion = 4
+
+var dlcMagic = []byte("DLC\x00")
+
+const dlcHeaderSize = 14
+
+// Constant tags in the payload.
+const (
+	constNumber byte = iota
+	constString
+	constFunction
+)
+
+// Write fn to w in the .dlc format.
+func writeCompiled(w io.Writer, fn *funcProto) error {
+	var e encoder
+	e.function(fn)
+	payload := e.buf.Bytes()
+
+	header := make([]byte, dlcHeaderSize)
+	copy(header, dlcMagic)
+	binary.BigEndian.PutUint16(header[4:], bytecodeVersion)
+	binary.BigEndian.PutUint32(header[6:], uint32(len(payload)))
+	binary.BigEndian.PutUint32(header[10:], crc32.ChecksumIEEE(payload))
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// Read a program written by writeCompiled, checking that it was built for this
+// version of the VM and hasn't been corrupted.
+func readCompiled(r io.Reader) (*funcProto, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < dlcHeaderSize || !bytes.Equal(data[:4], dlcMagic) {
+		return nil, errors.New("not a compiled deslang program")
+	}
+
+	version := binary.BigEndian.Uint16(data[4:])
+	if version != bytecodeVersion {
+		return nil, fmt.Errorf(
+			"compiled program has bytecode version %d but this deslang only runs version %d; recompile it from source",
+			version,
+			bytecodeVersion,
+		)
+	}
+
+	length := binary.BigEndian.Uint32(data[6:])
+	payload := data[dlcHeaderSize:]
+	if uint32(len(payload)) != length {
+		return nil, fmt.Errorf("compiled program is truncated: expected %d bytes but found %d", length, len(payload))
+	}
+
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(data[10:]) {
+		return nil, errors.New("compiled program is corrupt: checksum mismatch")
+	}
+
+	d := decoder{data: payload}
+	fn := d.function()
+	if d.err != nil {
+		return nil, d.err
+	}
+	if d.pos != len(payload) {
+		return nil, errors.New("compiled program is corrupt: unexpected trailing data")
+	}
+
+	return fn, nil
+}
+
+type encoder struct {
+	buf bytes.Buffer
+}
+
+func (e *encoder) uvarint(n int) {
+	var b [binary.MaxVarintLen64]byte
+	e.buf.Write(b[:binary.PutUvarint(b[:], uint64(n))])
+}
+
+func (e *encoder) string(s string) {
+	e.uvarint(len(s))
+	e.buf.WriteString(s)
+}
+
+// A function is its name, arity, upvalue count, stack size, code, spans and
+// constants.
+// Spans are run-length encoded as the span's line, column, start and end
+// followed by the number of bytes it covers, since every byte of an instruction
+// has the same span.
+func (e *encoder) function(fn *funcProto) {
+	e.string(fn.name)
+	e.uvarint(fn.arity)
+	e.uvarint(fn.upvalueCount)
+	e.uvarint(fn.maxStack)
+
+	c := &fn.chunk
+	e.uvarint(len(c.Code))
+	e.buf.Write(c.Code)
+
+	type run struct {
+		span  Span
+		count int
+	}
+	var runs []run
+	for _, span := range c.Spans {
+		if len(runs) > 0 && runs[len(runs)-1].span == span {
+			runs[len(runs)-1].count++
+		} else {
+			runs = append(runs, run{span, 1})
+		}
+	}
+
+	e.uvarint(len(runs))
+	for _, r := range runs {
+		e.uvarint(r.span.Line)
+		e.uvarint(r.span.Column)
+		e.uvarint(r.span.Start)
+		e.uvarint(r.span.End)
+		e.uvarint(r.count)
+	}
+
+	e.uvarint(len(c.Constants))
+	for _, constant := range c.Constants {
+		switch constant.Kind {
+		case floatLit:
+			var b [8]byte
+			binary.BigEndian.PutUint64(b[:], math.Float64bits(constant.num))
+			e.buf.WriteByte(constNumber)
+			e.buf.Write(b[:])
+		case stringLit:
+			e.buf.WriteByte(constString)
+			e.string(constant.str)
+		default:
+			e.buf.WriteByte(constFunction)
+			e.function(constant.ref.(*funcProto))
+		}
+	}
+}
+
+// Reads what encoder writes. The first error is kept in err and every read
+// after it returns a zero value.
+type decoder struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (d *decoder) fail() {
+	if d.err == nil {
+		d.err = errors.New("compiled program is corrupt: unexpected end of data")
+	}
+}
+
+func (d *decoder) uvarint() int {
+	if d.err != nil {
+		return 0
+	}
+
+	n, size := binary.Uvarint(d.data[d.pos:])
+	if size <= 0 || n > math.MaxInt32 {
+		d.fail()
+		return 0
+	}
+
+	d.pos += size
+	return int(n)
+}
+
+func (d *decoder) bytes(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+
+	if n > len(d.data)-d.pos {
+		d.fail()
+		return nil
+	}
+
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes(d.uvarint()))
+}
+
+func (d *decoder) function() *funcProto {
+	fn := &funcProto{
+		name:         d.string(),
+		arity:        d.uvarint(),
+		upvalueCount: d.uvarint(),
+		maxStack:     d.uvarint(),
+	}
+
+	c := &fn.chunk
+	c.Code = append([]byte(nil), d.bytes(d.uvarint())...)
+
+	runs := d.uvarint()
+	for i := 0; i < runs && d.err == nil; i++ {
+		span := Span{Line: d.uvarint(), Column: d.uvarint(), Start: d.uvarint(), End: d.uvarint()}
+		count := d.uvarint()
+		if len(c.Spans)+count > len(c.Code) {
+			d.fail()
+			break
+		}
+		for j := 0; j < count; j++ {
+			c.Spans = append(c.Spans, span)
+		}
+	}
+
+	if d.err == nil && len(c.Spans) != len(c.Code) {
+		d.err = errors.New("compiled program is corrupt: span table doesn't match code")
+	}
+
+	constants := d.uvarint()
+	for i := 0; i < constants && d.err == nil; i++ {
+		tag := d.bytes(1)
+		if tag == nil {
+			break
+		}
+
+		switch tag[0] {
+		case constNumber:
+			if b := d.bytes(8); b != nil {
+				c.Constants = append(c.Constants, NumberValue(math.Float64frombits(binary.BigEndian.Uint64(b))))
+			}
+		case constString:
+			c.Constants = append(c.Constants, StringValue(d.string()))
+		case constFunction:
+			c.Constants = append(c.Constants, Value{Kind: funcLit, ref: d.function()})
+		default:
+			d.err = fmt.Errorf("compiled program is corrupt: unknown constant tag %d", tag[0])
+		}
+	}
+
+	return fn
+}
@@ -0,0 +1,95 @@
+package deslang
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Compile src and return the .dlc bytes.
+func compileToBytes(t *testing.T, src string) []byte {
+	t.Helper()
+
+	var out strings.Builder
+	var dlc bytes.Buffer
+	if err := NewInterpreter(&out).Compile(strings.NewReader(src), &dlc); err != nil {
+		t.Fatalf("Compile: %v\n%s", err, out.String())
+	}
+	return dlc.Bytes()
+}
+
+// Run src on the VM and return what Run would print, except errors have no
+// source snippet since compiled programs don't have the source.
+func runWithoutSource(src string) string {
+	var out strings.Builder
+	interpreter := NewInterpreter(&out)
+	interpreter.SetBackend(BytecodeVM)
+
+	diags, _ := interpreter.Exec(strings.NewReader(src))
+	for _, d := range diags {
+		fmt.Fprintln(&out, d)
+		if trace := d.StackTrace(); trace != "" {
+			fmt.Fprintln(&out, trace)
+		}
+	}
+
+	return out.String()
+}
+
+// A compiled program prints the same as running its source.
+func TestCompiledRoundTrip(t *testing.T) {
+	for _, tt := range backendTests {
+		if len(tt.srcs) != 1 {
+			continue
+		}
+
+		t.Run(tt.name, func(t *testing.T) {
+			dlc := compileToBytes(t, tt.srcs[0])
+
+			var out strings.Builder
+			if err := NewInterpreter(&out).RunCompiled(bytes.NewReader(dlc)); err != nil {
+				t.Fatalf("RunCompiled: %v", err)
+			}
+
+			if want := runWithoutSource(tt.srcs[0]); out.String() != want {
+				t.Errorf("got\n%s\nwant\n%s", out.String(), want)
+			}
+		})
+	}
+}
+
+func TestCompiledRejectsBadFiles(t *testing.T) {
+	dlc := compileToBytes(t, `print "hi";`)
+
+	otherVersion := append([]byte(nil), dlc...)
+	binary.BigEndian.PutUint16(otherVersion[4:], bytecodeVersion+1)
+
+	corrupt := append([]byte(nil), dlc...)
+	corrupt[len(corrupt)-1] ^= 0xff
+
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"not compiled", []byte(`print "hi";`), "not a compiled deslang program"},
+		{"other version", otherVersion, "recompile it from source"},
+		{"truncated", dlc[:len(dlc)-1], "truncated"},
+		{"corrupt", corrupt, "checksum mismatch"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out strings.Builder
+			err := NewInterpreter(&out).RunCompiled(bytes.NewReader(tt.data))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got error %v, want one containing %q", err, tt.want)
+			}
+			if out.Len() > 0 {
+				t.Errorf("program ran and printed %q", out.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,306 @@
+package deslang
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Builtins defined in the global scope of every Interpreter.
+var stdlib = []struct {
+	name  string
+	arity int
+	fn    NativeFunc
+}{
+	{"clock", 0, clock},
+	{"sqrt", 1, sqrt},
+	{"floor", 1, floor},
+	{"pow", 2, pow},
+	{"len", 1, length},
+	{"substr", 3, substr},
+	{"upper", 1, upper},
+	{"lower", 1, lower},
+	{"indexOf", 2, indexOf},
+	{"toNumber", 1, toNumber},
+	{"toString", 1, toString},
+	{"typeOf", 1, typeOf},
+	{"push", 2, push},
+	{"pop", 1, pop},
+	{"slice", 3, slice},
+	{"keys", 1, keys},
+	{"values", 1, values},
+	{"has", 2, has},
+}
+
+func argError(fn string, i int, want string, got Value) error {
+	return fmt.Errorf("%s: argument %d must be a %s, got %s.", fn, i+1, want, got.Type())
+}
+
+func numberArg(fn string, args []Value, i int) (float64, error) {
+	if args[i].Kind != floatLit {
+		return 0, argError(fn, i, "number", args[i])
+	}
+	return args[i].num, nil
+}
+
+func intArg(fn string, args []Value, i int) (int, error) {
+	f, err := numberArg(fn, args, i)
+	if err != nil {
+		return 0, err
+	}
+
+	if f != math.Trunc(f) {
+		return 0, fmt.Errorf("%s: argument %d must be a whole number.", fn, i+1)
+	}
+
+	return int(f), nil
+}
+
+func stringArg(fn string, args []Value, i int) (string, error) {
+	if args[i].Kind != stringLit {
+		return "", argError(fn, i, "string", args[i])
+	}
+	return args[i].str, nil
+}
+
+func listArg(fn string, args []Value, i int) (*list, error) {
+	if args[i].Kind != listLit {
+		return nil, argError(fn, i, "list", args[i])
+	}
+	return args[i].ref.(*list), nil
+}
+
+func mapArg(fn string, args []Value, i int) (*dict, error) {
+	if args[i].Kind != mapLit {
+		return nil, argError(fn, i, "map", args[i])
+	}
+	return args[i].ref.(*dict), nil
+}
+
+// Checks that start and end describe a valid range of a sequence of the given
+// length.
+func rangeArgs(fn string, args []Value, length int) (int, int, error) {
+	start, err := intArg(fn, args, 1)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	end, err := intArg(fn, args, 2)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if start < 0 || end > length || start > end {
+		err := fmt.Errorf("%s: range [%d, %d) out of bounds for length %d.", fn, start, end, length)
+		return 0, 0, err
+	}
+
+	return start, end, nil
+}
+
+// Seconds since the Unix epoch.
+func clock(args []Value) (Value, error) {
+	return NumberValue(float64(time.Now().UnixNano()) / 1e9), nil
+}
+
+func sqrt(args []Value) (Value, error) {
+	n, err := numberArg("sqrt", args, 0)
+	if err != nil {
+		return Nil, err
+	}
+	return NumberValue(math.Sqrt(n)), nil
+}
+
+func floor(args []Value) (Value, error) {
+	n, err := numberArg("floor", args, 0)
+	if err != nil {
+		return Nil, err
+	}
+	return NumberValue(math.Floor(n)), nil
+}
+
+func pow(args []Value) (Value, error) {
+	x, err := numberArg("pow", args, 0)
+	if err != nil {
+		return Nil, err
+	}
+
+	y, err := numberArg("pow", args, 1)
+	if err != nil {
+		return Nil, err
+	}
+
+	return NumberValue(math.Pow(x, y)), nil
+}
+
+// Number of bytes in a string, items in a list or entries in a map.
+func length(args []Value) (Value, error) {
+	switch args[0].Kind {
+	case stringLit:
+		return NumberValue(float64(len(args[0].str))), nil
+	case listLit:
+		return NumberValue(float64(len(args[0].ref.(*list).items))), nil
+	case mapLit:
+		return NumberValue(float64(len(args[0].ref.(*dict).keys))), nil
+	}
+
+	return Nil, argError("len", 0, "string, list or map", args[0])
+}
+
+// substr(s, start, end) returns the bytes of s from start up to but not
+// including end.
+func substr(args []Value) (Value, error) {
+	s, err := stringArg("substr", args, 0)
+	if err != nil {
+		return Nil, err
+	}
+
+	start, end, err := rangeArgs("substr", args, len(s))
+	if err != nil {
+		return Nil, err
+	}
+
+	return StringValue(s[start:end]), nil
+}
+
+func upper(args []Value) (Value, error) {
+	s, err := stringArg("upper", args, 0)
+	if err != nil {
+		return Nil, err
+	}
+	return StringValue(strings.ToUpper(s)), nil
+}
+
+func lower(args []Value) (Value, error) {
+	s, err := stringArg("lower", args, 0)
+	if err != nil {
+		return Nil, err
+	}
+	return StringValue(strings.ToLower(s)), nil
+}
+
+// Index of the first occurrence of sub in s, or -1 if it isn't there.
+func indexOf(args []Value) (Value, error) {
+	s, err := stringArg("indexOf", args, 0)
+	if err != nil {
+		return Nil, err
+	}
+
+	sub, err := stringArg("indexOf", args, 1)
+	if err != nil {
+		return Nil, err
+	}
+
+	return NumberValue(float64(strings.Index(s, sub))), nil
+}
+
+// Numbers are returned as is. Strings that aren't numbers return nil.
+func toNumber(args []Value) (Value, error) {
+	switch args[0].Kind {
+	case floatLit:
+		return args[0], nil
+	case stringLit:
+		f, err := strconv.ParseFloat(strings.TrimSpace(args[0].str), 64)
+		if err != nil {
+			return Nil, nil
+		}
+		return NumberValue(f), nil
+	}
+
+	return Nil, argError("toNumber", 0, "string", args[0])
+}
+
+// Same as the output of print.
+func toString(args []Value) (Value, error) {
+	return StringValue(args[0].String()), nil
+}
+
+func typeOf(args []Value) (Value, error) {
+	return StringValue(args[0].Type()), nil
+}
+
+// Append a value to the end of a list.
+func push(args []Value) (Value, error) {
+	l, err := listArg("push", args, 0)
+	if err != nil {
+		return Nil, err
+	}
+
+	l.items = append(l.items, args[1])
+	return Nil, nil
+}
+
+// Remove and return the last value of a list.
+func pop(args []Value) (Value, error) {
+	l, err := listArg("pop", args, 0)
+	if err != nil {
+		return Nil, err
+	}
+
+	if len(l.items) == 0 {
+		return Nil, errors.New("pop: list is empty.")
+	}
+
+	last := l.items[len(l.items)-1]
+	l.items = l.items[:len(l.items)-1]
+	return last, nil
+}
+
+// slice(xs, start, end) returns a new list holding the items of xs from start up
+// to but not including end. Strings are sliced the same as substr.
+func slice(args []Value) (Value, error) {
+	if args[0].Kind == stringLit {
+		return substr(args)
+	}
+
+	l, err := listArg("slice", args, 0)
+	if err != nil {
+		return Nil, err
+	}
+
+	start, end, err := rangeArgs("slice", args, len(l.items))
+	if err != nil {
+		return Nil, err
+	}
+
+	items := make([]Value, end-start)
+	copy(items, l.items[start:end])
+	return listValue(&list{items: items}), nil
+}
+
+// List of a map's keys in insertion order.
+func keys(args []Value) (Value, error) {
+	d, err := mapArg("keys", args, 0)
+	if err != nil {
+		return Nil, err
+	}
+
+	items := make([]Value, len(d.keys))
+	copy(items, d.keys)
+	return listValue(&list{items: items}), nil
+}
+
+// List of a map's values in the same order as keys.
+func values(args []Value) (Value, error) {
+	d, err := mapArg("values", args, 0)
+	if err != nil {
+		return Nil, err
+	}
+
+	items := make([]Value, len(d.values))
+	copy(items, d.values)
+	return listValue(&list{items: items}), nil
+}
+
+func has(args []Value) (Value, error) {
+	d, err := mapArg("has", args, 0)
+	if err != nil {
+		return Nil, err
+	}
+
+	_, found := d.get(args[1])
+	return BoolValue(found), nil
+}
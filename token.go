@@ -8,52 +8,92 @@ type (
 		Lexeme  []byte
 		Literal []byte
 		Line    int
+		Column  int    // column of the first byte, starting at 1
+		Start   int    // byte offset of the first byte in the source
+		End     int    // byte offset just past the last byte
+		str     string // Lexeme of an identifier, interned, or Literal of a string
+	}
+
+	// A range of source code, e.g. everything making up an AST node. Line and
+	// Column are the position of Start.
+	Span struct {
+		Start, End   int
+		Line, Column int
 	}
 )
 
+// Nodes embed a Span, which makes them satisfy the SourceSpan method of Expr and
+// Stmt.
+func (s Span) SourceSpan() Span {
+	return s
+}
+
+func (t Token) span() Span {
+	return Span{Start: t.Start, End: t.End, Line: t.Line, Column: t.Column}
+}
+
+// The name of an identifier. Identifiers are interned by the Scanner, so this
+// doesn't allocate except for tokens made up outside it.
+func (t Token) name() string {
+	if t.str != "" {
+		return t.str
+	}
+	return string(t.Lexeme)
+}
+
 const (
 	_ tokentype = iota
 
 	// Single-character tokens.
-	_left_paren  // 1
-	_right_paren // 2
-	_left_brace  // 3
-	_right_brace // 4
-	_comma       // 5
-	_minus       // 6
-	_plus        // 7
-	_semicolon   // 8
-	_slash       // 9
-	_star        // 10
+	_left_paren    // 1
+	_right_paren   // 2
+	_left_brace    // 3
+	_right_brace   // 4
+	_left_bracket  // 5
+	_right_bracket // 6
+	_colon         // 7
+	_comma         // 8
+	_dot           // 9
+	_minus         // 10
+	_plus          // 11
+	_semicolon     // 12
+	_slash         // 13
+	_star          // 14
 
 	// One or two character tokens.
-	_bang          // 11
-	_bang_equal    // 12
-	_equal         // 13
-	_equal_equal   // 14
-	_greater       // 15
-	_greater_equal // 16
-	_less          // 17
-	_less_equal    // 18
+	_bang          // 15
+	_bang_equal    // 16
+	_equal         // 17
+	_equal_equal   // 18
+	_greater       // 19
+	_greater_equal // 20
+	_less          // 21
+	_less_equal    // 22
 
 	// Literals.
-	_identifier // 19
-	_string     // 20
-	_number     // 21
+	_identifier // 23
+	_string     // 24
+	_number     // 25
 
 	// Keywords.
-	_and    // 22
-	_else   // 23
-	_false  // 24
-	_fun    // 25
-	_for    // 26
-	_if     // 27
-	_nil    // 28
-	_or     // 29
-	_print  // 30
-	_return // 31
-	_true   // 32
-	_var    // 33
-	_while  // 34
-	_eof    // 35
+	_and      // 26
+	_break    // 27
+	_class    // 28
+	_continue // 29
+	_else     // 30
+	_false    // 31
+	_fun      // 32
+	_for      // 33
+	_if       // 34
+	_in       // 35
+	_nil      // 36
+	_or       // 37
+	_print    // 38
+	_return   // 39
+	_super    // 40
+	_this     // 41
+	_true     // 42
+	_var      // 43
+	_while    // 44
+	_eof      // 45
 )
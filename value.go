@@ -0,0 +1,152 @@
+package deslang
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+type litKind uint
+
+const (
+	nilLit litKind = iota
+	floatLit
+	stringLit
+	boolLit
+	funcLit
+	classLit
+	instanceLit
+	listLit
+	mapLit
+)
+
+var types = map[litKind]string{
+	nilLit:      "nil",
+	floatLit:    "float",
+	stringLit:   "string",
+	boolLit:     "boolean",
+	funcLit:     "function",
+	classLit:    "class",
+	instanceLit: "instance",
+	listLit:     "list",
+	mapLit:      "map",
+}
+
+// A runtime value. Kind decides which of the other fields holds the value;
+// the rest are left empty.
+type Value struct {
+	Kind    litKind
+	num     float64     // floatLit
+	boolean bool        // boolLit
+	str     string      // stringLit
+	ref     interface{} // funcLit, classLit, instanceLit, listLit, mapLit
+}
+
+// The nil value. It's also the zero value of Value.
+var Nil = Value{Kind: nilLit}
+
+func NumberValue(f float64) Value {
+	return Value{Kind: floatLit, num: f}
+}
+
+func StringValue(s string) Value {
+	return Value{Kind: stringLit, str: s}
+}
+
+func BoolValue(b bool) Value {
+	return Value{Kind: boolLit, boolean: b}
+}
+
+func funcValue(fn Callable) Value {
+	return Value{Kind: funcLit, ref: fn}
+}
+
+func classValue(c *class) Value {
+	return Value{Kind: classLit, ref: c}
+}
+
+func instanceValue(inst *instance) Value {
+	return Value{Kind: instanceLit, ref: inst}
+}
+
+func listValue(l *list) Value {
+	return Value{Kind: listLit, ref: l}
+}
+
+func mapValue(d *dict) Value {
+	return Value{Kind: mapLit, ref: d}
+}
+
+func (v Value) IsNil() bool       { return v.Kind == nilLit }
+func (v Value) IsNumber() bool    { return v.Kind == floatLit }
+func (v Value) IsString() bool    { return v.Kind == stringLit }
+func (v Value) IsBool() bool      { return v.Kind == boolLit }
+func (v Value) AsNumber() float64 { return v.num }
+func (v Value) AsString() string  { return v.str }
+func (v Value) AsBool() bool      { return v.boolean }
+
+// Name of the value's type, e.g. "float".
+func (v Value) Type() string {
+	return types[v.Kind]
+}
+
+// Formats the value the way print displays it.
+func (v Value) String() string {
+	switch v.Kind {
+	case nilLit:
+		return "nil"
+	case floatLit:
+		return formatNumber(v.num)
+	case stringLit:
+		return v.str
+	case boolLit:
+		return strconv.FormatBool(v.boolean)
+	default:
+		return fmt.Sprint(v.ref)
+	}
+}
+
+// Whole numbers are printed without a decimal point or exponent unless they're
+// too large to read that way.
+func formatNumber(f float64) string {
+	if f == math.Trunc(f) && math.Abs(f) < 1e15 {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func isTruthy(v Value) bool {
+	switch v.Kind {
+	case nilLit:
+		return false
+	case floatLit:
+		return v.num != 0
+	case stringLit:
+		return len(v.str) > 0
+	case boolLit:
+		return v.boolean
+	default:
+		return true
+	}
+}
+
+// Values of different kinds are never equal. Functions, classes, instances,
+// lists and maps are only equal to themselves.
+func isEqual(a, b Value) bool {
+	if a.Kind != b.Kind {
+		return false
+	}
+
+	switch a.Kind {
+	case nilLit:
+		return true
+	case floatLit:
+		return a.num == b.num
+	case stringLit:
+		return a.str == b.str
+	case boolLit:
+		return a.boolean == b.boolean
+	default:
+		return a.ref == b.ref
+	}
+}
@@ -0,0 +1,613 @@
+package deslang
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	framesMax = 256
+	stackMax  = framesMax * maxLocals
+)
+
+// Stack-based virtual machine that runs the bytecode produced by compile.
+// Globals live in the same Environment the tree-walking interpreter uses, so
+// natives defined with Interpreter.DefineNative are available to both.
+type vm struct {
+	out          io.Writer
+	globals      *Environment
+	stack        []Value // never grows, so upvalues can point into it
+	sp           int     // index of the next free slot
+	stackHigh    int     // no call since the last collection used slots above this
+	frames       []callFrame
+	openUpvalues *upvalue // upvalues still pointing into the stack, highest slot first
+
+	// Garbage collector state, see gc.go.
+	heap      []heapObject // every object the VM owns
+	heapBytes int
+	nextGC    int
+	gcPercent int
+	gcCycle   uint32       // number of the latest collection
+	gray      []heapObject // kept between collections to reuse its memory
+	gcStats   GCStats
+}
+
+// A function call in progress.
+type callFrame struct {
+	closure *closure
+	ip      int // index of the next instruction
+	base    int // stack index of slot 0
+}
+
+// ----------------------------------------------------------------------------
+// Runtime objects
+
+// A funcProto along with the variables it captured.
+type closure struct {
+	gcHeader
+	proto    *funcProto
+	upvalues []*upvalue
+}
+
+func (cl *closure) String() string {
+	return cl.proto.String()
+}
+
+// A captured variable. While the variable is still on the stack location points
+// at its slot; once it goes out of scope the value is moved into closed and
+// location points there instead.
+type upvalue struct {
+	gcHeader
+	location *Value
+	closed   Value
+	slot     int
+	next     *upvalue
+}
+
+// Superclass methods are copied into the class when it inherits, so methods are
+// never looked up on the superclass at runtime.
+type vmClass struct {
+	gcHeader
+	name    string
+	methods map[string]*closure
+}
+
+func (c *vmClass) String() string {
+	return c.name
+}
+
+type vmInstance struct {
+	gcHeader
+	class  *vmClass
+	fields map[string]Value
+}
+
+func (inst *vmInstance) String() string {
+	return inst.class.name + " instance"
+}
+
+// A method accessed on an instance, remembering the instance for 'this'.
+type boundMethod struct {
+	gcHeader
+	receiver Value
+	method   *closure
+}
+
+func (bm *boundMethod) String() string {
+	return bm.method.String()
+}
+
+// ----------------------------------------------------------------------------
+// Execution
+
+func newVM(out io.Writer, globals *Environment, gcPercent int) *vm {
+	vm := &vm{
+		out:     out,
+		globals: globals,
+		stack:   make([]Value, stackMax),
+		frames:  make([]callFrame, 0, framesMax),
+	}
+	vm.setGCPercent(gcPercent)
+	return vm
+}
+
+func (vm *vm) reset() {
+	vm.sp = 0
+	vm.frames = vm.frames[:0]
+	vm.openUpvalues = nil
+}
+
+func (vm *vm) push(v Value) {
+	vm.stack[vm.sp] = v
+	vm.sp++
+}
+
+func (vm *vm) pop() Value {
+	vm.sp--
+	return vm.stack[vm.sp]
+}
+
+func (vm *vm) peek(distance int) Value {
+	return vm.stack[vm.sp-1-distance]
+}
+
+// Run a compiled script. Runtime errors are returned with the same messages the
+// tree-walking interpreter uses.
+func (vm *vm) interpret(fn *funcProto) error {
+	vm.reset()
+
+	cl := &closure{proto: fn}
+	vm.track(cl)
+	vm.push(Value{Kind: funcLit, ref: cl})
+	if err := vm.call(cl, 0); err != nil {
+		return err
+	}
+
+	err := vm.run()
+	if err != nil {
+		err = vm.runtimeError(err)
+		// Closures that escaped, e.g. into a global, must keep the values
+		// they captured rather than point at stack slots the next run reuses.
+		vm.closeUpvalues(0)
+		vm.reset()
+	}
+	return err
+}
+
+// Give an error from run the line of the instruction that failed and a stack
+// trace of the call frames, the same as the tree-walking interpreter reports.
+func (vm *vm) runtimeError(err error) error {
+	re, ok := err.(*runtimeError)
+	if !ok {
+		re = &runtimeError{msg: err.Error()}
+	}
+
+	// ip has already moved past the failing instruction's opcode, but every
+	// byte of an instruction has the same span.
+	span := func(frame *callFrame) Span {
+		return frame.closure.proto.chunk.Spans[frame.ip-1]
+	}
+	line := func(frame *callFrame) int {
+		return span(frame).Line
+	}
+
+	top := &vm.frames[len(vm.frames)-1]
+	re.pos = span(top)
+	re.at = re.pos.Line
+	re.trace = nil
+
+	for i := len(vm.frames) - 1; i > 0; i-- {
+		re.unwind(vm.frames[i].closure.proto.name, line(&vm.frames[i-1]))
+	}
+
+	return re
+}
+
+func (vm *vm) call(cl *closure, argc int) error {
+	if argc != cl.proto.arity {
+		return fmt.Errorf("Expected %d arguments but got %d.", cl.proto.arity, argc)
+	}
+
+	// The stack can't grow since upvalues point into it, so a call that would
+	// need more of it than is left fails the same as one too many frames.
+	base := vm.sp - argc - 1
+	if len(vm.frames) == framesMax || base+cl.proto.maxStack > stackMax {
+		return errors.New("Stack overflow.")
+	}
+
+	if top := base + cl.proto.maxStack; top > vm.stackHigh {
+		vm.stackHigh = top
+	}
+
+	vm.frames = append(vm.frames, callFrame{
+		closure: cl,
+		base:    base,
+	})
+	return nil
+}
+
+// The callee is on the stack below its arguments.
+func (vm *vm) callValue(callee Value, argc int) error {
+	switch fn := callee.ref.(type) {
+	case *closure:
+		return vm.call(fn, argc)
+	case *boundMethod:
+		vm.stack[vm.sp-argc-1] = fn.receiver
+		return vm.call(fn.method, argc)
+	case *vmClass:
+		inst := &vmInstance{class: fn, fields: make(map[string]Value)}
+		vm.track(inst)
+		vm.stack[vm.sp-argc-1] = Value{Kind: instanceLit, ref: inst}
+		if init, has := fn.methods["init"]; has {
+			return vm.call(init, argc)
+		}
+		if argc != 0 {
+			return fmt.Errorf("Expected 0 arguments but got %d.", argc)
+		}
+		return nil
+	case Callable:
+		// Natives, or functions created by the tree-walking interpreter.
+		if callee.Kind != funcLit && callee.Kind != classLit {
+			break
+		}
+
+		if fn.Arity() >= 0 && argc != fn.Arity() {
+			return fmt.Errorf("Expected %d arguments but got %d.", fn.Arity(), argc)
+		}
+
+		args := make([]Value, argc)
+		copy(args, vm.stack[vm.sp-argc:vm.sp])
+
+		result, err := fn.Call(vm.globals, args)
+		if err != nil {
+			return err
+		}
+		vm.adopt(result)
+
+		vm.sp -= argc + 1
+		vm.push(result)
+		return nil
+	}
+
+	return errors.New("Can only call functions and classes.")
+}
+
+func (vm *vm) bindMethod(class *vmClass, receiver Value, name string) (Value, error) {
+	method, has := class.methods[name]
+	if !has {
+		return Nil, errors.New("Undefined property '" + name + "'.")
+	}
+
+	bound := &boundMethod{receiver: receiver, method: method}
+	vm.track(bound)
+	return Value{Kind: funcLit, ref: bound}, nil
+}
+
+func (vm *vm) captureUpvalue(slot int) *upvalue {
+	var prev *upvalue
+	up := vm.openUpvalues
+
+	for up != nil && up.slot > slot {
+		prev = up
+		up = up.next
+	}
+
+	if up != nil && up.slot == slot {
+		return up
+	}
+
+	created := &upvalue{location: &vm.stack[slot], slot: slot, next: up}
+	vm.track(created)
+	if prev == nil {
+		vm.openUpvalues = created
+	} else {
+		prev.next = created
+	}
+
+	return created
+}
+
+// Close every open upvalue pointing at slot last or above.
+func (vm *vm) closeUpvalues(last int) {
+	for vm.openUpvalues != nil && vm.openUpvalues.slot >= last {
+		up := vm.openUpvalues
+		up.closed = *up.location
+		up.location = &up.closed
+		vm.openUpvalues = up.next
+	}
+}
+
+func (vm *vm) run() error {
+	frame := &vm.frames[len(vm.frames)-1]
+	chunk := &frame.closure.proto.chunk
+
+	readByte := func() byte {
+		b := chunk.Code[frame.ip]
+		frame.ip++
+		return b
+	}
+
+	readShort := func() int {
+		s := chunk.readShort(frame.ip)
+		frame.ip += 2
+		return s
+	}
+
+	readString := func() string {
+		return chunk.Constants[readShort()].str
+	}
+
+	for {
+		if vm.heapBytes > vm.nextGC {
+			vm.collect()
+		}
+
+		start := frame.ip
+		op := opcode(readByte())
+
+		// Position for errors raised by the current instruction.
+		at := func() Span {
+			return chunk.Spans[start]
+		}
+
+		switch op {
+		case opConstant:
+			vm.push(chunk.Constants[readShort()])
+
+		case opNil:
+			vm.push(Nil)
+
+		case opTrue:
+			vm.push(BoolValue(true))
+
+		case opFalse:
+			vm.push(BoolValue(false))
+
+		case opPop:
+			vm.sp--
+
+		case opGetLocal:
+			vm.push(vm.stack[frame.base+int(readByte())])
+
+		case opSetLocal:
+			vm.stack[frame.base+int(readByte())] = vm.peek(0)
+
+		case opGetGlobal:
+			name := readString()
+			val, has := vm.globals.lookup(name)
+			if !has {
+				return errors.New("Undefined variable '" + name + "'.")
+			}
+			vm.push(val)
+
+		case opDefineGlobal:
+			vm.globals.Define(readString(), vm.pop())
+
+		case opSetGlobal:
+			name := readString()
+			slot, has := vm.globals.names[name]
+			if !has {
+				return errors.New("Undefined variable '" + name + "'.")
+			}
+			vm.globals.values[slot] = vm.peek(0)
+
+		case opGetUpvalue:
+			vm.push(*frame.closure.upvalues[readByte()].location)
+
+		case opSetUpvalue:
+			*frame.closure.upvalues[readByte()].location = vm.peek(0)
+
+		case opGetProperty:
+			name := readString()
+			inst, ok := vm.peek(0).ref.(*vmInstance)
+			if !ok || vm.peek(0).Kind != instanceLit {
+				return errors.New("Only instances have properties.")
+			}
+
+			if val, has := inst.fields[name]; has {
+				vm.stack[vm.sp-1] = val
+				break
+			}
+
+			bound, err := vm.bindMethod(inst.class, vm.peek(0), name)
+			if err != nil {
+				return err
+			}
+			vm.stack[vm.sp-1] = bound
+
+		case opSetProperty:
+			name := readString()
+			inst, ok := vm.peek(1).ref.(*vmInstance)
+			if !ok || vm.peek(1).Kind != instanceLit {
+				return errors.New("Only instances have fields.")
+			}
+
+			val := vm.pop()
+			inst.fields[name] = val
+			vm.stack[vm.sp-1] = val
+
+		case opGetSuper:
+			name := readString()
+			superclass := vm.pop().ref.(*vmClass)
+
+			bound, err := vm.bindMethod(superclass, vm.peek(0), name)
+			if err != nil {
+				return err
+			}
+			vm.stack[vm.sp-1] = bound
+
+		case opEqual, opNotEqual, opGreater, opGreaterEqual, opLess, opLessEqual,
+			opAdd, opSubtract, opMultiply, opDivide:
+			b := vm.pop()
+			a := vm.pop()
+
+			// Numbers are by far the most common operands, so they skip the
+			// general path.
+			if a.Kind == floatLit && b.Kind == floatLit {
+				switch op {
+				case opAdd:
+					vm.push(NumberValue(a.num + b.num))
+					continue
+				case opSubtract:
+					vm.push(NumberValue(a.num - b.num))
+					continue
+				case opLess:
+					vm.push(BoolValue(a.num < b.num))
+					continue
+				}
+			}
+
+			result, err := binaryOp(opTokens[op], a, b)
+			if err != nil {
+				return err
+			}
+			vm.push(result)
+
+		case opNot, opNegate:
+			result, err := unaryOp(opTokens[op], vm.pop())
+			if err != nil {
+				return err
+			}
+			vm.push(result)
+
+		case opPrint:
+			fmt.Fprintln(vm.out, vm.pop())
+
+		case opEcho:
+			if val := vm.pop(); !val.IsNil() {
+				fmt.Fprintln(vm.out, val)
+			}
+
+		case opJump:
+			offset := readShort()
+			frame.ip += offset
+
+		case opJumpIfFalse:
+			offset := readShort()
+			if !isTruthy(vm.peek(0)) {
+				frame.ip += offset
+			}
+
+		case opLoop:
+			offset := readShort()
+			frame.ip -= offset
+
+		case opCall:
+			argc := int(readByte())
+			if err := vm.callValue(vm.peek(argc), argc); err != nil {
+				return err
+			}
+			frame = &vm.frames[len(vm.frames)-1]
+			chunk = &frame.closure.proto.chunk
+
+		case opClosure:
+			proto := chunk.Constants[readShort()].ref.(*funcProto)
+			cl := &closure{
+				proto:    proto,
+				upvalues: make([]*upvalue, proto.upvalueCount),
+			}
+
+			for i := range cl.upvalues {
+				isLocal := readByte()
+				index := int(readByte())
+				if isLocal == 1 {
+					cl.upvalues[i] = vm.captureUpvalue(frame.base + index)
+				} else {
+					cl.upvalues[i] = frame.closure.upvalues[index]
+				}
+			}
+
+			vm.track(cl)
+			vm.push(Value{Kind: funcLit, ref: cl})
+
+		case opCloseUpvalue:
+			vm.closeUpvalues(vm.sp - 1)
+			vm.sp--
+
+		case opReturn:
+			result := vm.pop()
+			vm.closeUpvalues(frame.base)
+
+			vm.sp = frame.base
+			vm.frames = vm.frames[:len(vm.frames)-1]
+			if len(vm.frames) == 0 {
+				return nil
+			}
+
+			vm.push(result)
+			frame = &vm.frames[len(vm.frames)-1]
+			chunk = &frame.closure.proto.chunk
+
+		case opClass:
+			class := &vmClass{name: readString(), methods: make(map[string]*closure)}
+			vm.track(class)
+			vm.push(Value{Kind: classLit, ref: class})
+
+		case opInherit:
+			superclass, ok := vm.peek(1).ref.(*vmClass)
+			if !ok || vm.peek(1).Kind != classLit {
+				return errors.New("Superclass must be a class.")
+			}
+
+			class := vm.peek(0).ref.(*vmClass)
+			for name, method := range superclass.methods {
+				class.methods[name] = method
+			}
+
+		case opMethod:
+			name := readString()
+			method := vm.pop().ref.(*closure)
+			vm.peek(0).ref.(*vmClass).methods[name] = method
+
+		case opList:
+			n := readShort()
+			items := make([]Value, n)
+			copy(items, vm.stack[vm.sp-n:vm.sp])
+			vm.sp -= n
+
+			l := &list{items: items}
+			vm.track(l)
+			vm.push(listValue(l))
+
+		case opMap:
+			d := newDict()
+			vm.track(d)
+			vm.push(mapValue(d))
+
+		case opMapEntry:
+			val := vm.pop()
+			key := vm.pop()
+			if err := checkKey(key, at()); err != nil {
+				return err
+			}
+			vm.peek(0).ref.(*dict).set(key, val)
+
+		case opIndexGet:
+			idx := vm.pop()
+			val, err := indexGet(vm.peek(0), idx, at())
+			if err != nil {
+				return err
+			}
+			vm.stack[vm.sp-1] = val
+
+		case opIndexSet:
+			val := vm.pop()
+			idx := vm.pop()
+			if err := indexSet(vm.peek(0), idx, val, at()); err != nil {
+				return err
+			}
+			vm.stack[vm.sp-1] = val
+
+		case opForIter:
+			slot := frame.base + int(readByte())
+			count := readByte()
+			offset := readShort()
+
+			iterable := vm.stack[slot]
+			i := int(vm.stack[slot+1].num)
+
+			key, val, next, ok, err := iterate(iterable, i, at())
+			if err != nil {
+				return err
+			}
+
+			if !ok {
+				frame.ip += offset
+				break
+			}
+
+			vm.stack[slot+1] = NumberValue(float64(next))
+			if count == 1 {
+				vm.push(singleLoopVar(iterable, key, val))
+			} else {
+				vm.push(key)
+				vm.push(val)
+			}
+
+		default:
+			// Skipping it would run its operands as instructions.
+			return fmt.Errorf("Unknown opcode %d.", op)
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package deslang
+
+import (
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Run each source in turn on a new Interpreter using backend and return
+// everything printed, including errors.
+func runOn(backend Backend, srcs ...string) string {
+	var out strings.Builder
+	interpreter := NewInterpreter(&out)
+	interpreter.SetBackend(backend)
+
+	for _, src := range srcs {
+		interpreter.Run(strings.NewReader(src))
+	}
+
+	return out.String()
+}
+
+// Programs that exercise every kind of statement and expression, plus runtime
+// errors. Each test is a series of sources run one after another by the same
+// Interpreter, like lines typed into the REPL.
+var backendTests = []struct {
+	name string
+	srcs []string
+	want string // expected output; empty to only compare the backends
+}{
+	{name: "arithmetic", srcs: []string{`
+		print 1 + 2 * 3 - 4 / 2;
+		print -(3) + 10;
+		print "a" + "b";
+		print !nil;
+		print 1 < 2 and 2 <= 2 or false;
+	`}},
+	{name: "equality", srcs: []string{`
+		print 1 == nil;
+		print "1" != 1;
+		print nil == nil;
+		print {"a": 1}["b"] == nil;
+	`}, want: "false\ntrue\ntrue\ntrue\n"},
+	{name: "scopes", srcs: []string{`
+		var a = "global";
+		{
+			var a = "outer";
+			{
+				var a = "inner";
+				print a;
+			}
+			print a;
+		}
+		print a;
+	`}},
+	{name: "loops", srcs: []string{`
+		for (var i = 0; i < 5; i = i + 1) {
+			if (i == 1) continue;
+			if (i == 4) break;
+			print i;
+		}
+		var n = 0;
+		while (n < 3) n = n + 1;
+		print n;
+		for (k, v in {"a": 1, "b": 2}) print k + toString(v);
+		for (x in [1, 2]) print x;
+	`}},
+	{name: "string iteration", srcs: []string{`
+		for (c in "héllo") print c;
+		for (i, c in "aéb") print toString(i) + c;
+	`}, want: "h\né\nl\nl\no\n0a\n1é\n3b\n"},
+	{name: "closures", srcs: []string{`
+		fun counter() {
+			var n = 0;
+			fun inc() {
+				n = n + 1;
+				return n;
+			}
+			return inc;
+		}
+		var c = counter();
+		c();
+		print c();
+		var fs = [];
+		for (var i = 0; i < 3; i = i + 1) {
+			var j = i;
+			fun f() { return j; }
+			push(fs, f);
+		}
+		for (f in fs) print f();
+	`}},
+	{name: "classes", srcs: []string{`
+		class A {
+			init(x) { this.x = x; }
+			get() { return this.x; }
+		}
+		class B < A {
+			get() { return super.get() * 2; }
+		}
+		var b = B(21);
+		print b.get();
+		print b;
+		print B;
+	`}},
+	{name: "collections", srcs: []string{`
+		var l = [1, "two", [3]];
+		l[0] = 10;
+		print l;
+		var m = {"k": l};
+		m["self"] = m;
+		push(l, l);
+		print m;
+	`}},
+	{name: "runtime error trace", srcs: []string{`
+		fun inner() { return 1 + "a"; }
+		fun outer() { return inner(); }
+		outer();
+	`}},
+	{name: "stack overflow", srcs: []string{
+		"fun f(n) { return f(n + 1); }\nf(0);",
+	}, want: "[line 1] Stack overflow.\n" +
+		"fun f(n) { return f(n + 1); }\n" +
+		"                  ^^^^^^^^\n" +
+		"[line 1] in f()\n" +
+		"... 254 more calls to f()\n" +
+		"[line 2] in script\n"},
+	{name: "arity", srcs: []string{`
+		fun f(a, b) {}
+		f(1);
+	`}},
+	{name: "escaped closure after error", srcs: []string{
+		`var f; { var a = "captured"; fun g() { return a; } f = g; nope; }`,
+		`{ var x = "clobbered"; print f(); }`,
+	}, want: "[line 1] Undefined variable 'nope'.\n" +
+		`var f; { var a = "captured"; fun g() { return a; } f = g; nope; }` + "\n" +
+		"                                                          ^^^^\n" +
+		"captured\n"},
+	{name: "globals persist between runs", srcs: []string{
+		`var a = 1;`,
+		`a = a + 1;`,
+		`print a;`,
+	}, want: "2\n"},
+}
+
+func TestBackendsAgree(t *testing.T) {
+	for _, tt := range backendTests {
+		t.Run(tt.name, func(t *testing.T) {
+			tree := runOn(TreeWalker, tt.srcs...)
+			vm := runOn(BytecodeVM, tt.srcs...)
+
+			if tree != vm {
+				t.Errorf("backends disagree\ntree-walker:\n%s\nvm:\n%s", tree, vm)
+			}
+			if tt.want != "" && tree != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", tree, tt.want)
+			}
+		})
+	}
+}
+
+// Instructions the VM doesn't know are reported rather than skipped, which
+// would run their operands as instructions.
+func TestUnknownOpcode(t *testing.T) {
+	var out strings.Builder
+	interpreter := NewInterpreter(&out)
+	interpreter.SetBackend(BytecodeVM)
+	interpreter.interpretVM(&funcProto{chunk: Chunk{Code: []byte{255}, Spans: []Span{{Line: 1}}}})
+	interpreter.report()
+
+	if got, want := out.String(), "[line 1] Unknown opcode 255.\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// Both backends report where in the source a runtime error happened.
+func TestRuntimeDiagnosticPosition(t *testing.T) {
+	src := "var a = 1;\nprint a + \"x\";\n"
+	want := Diagnostic{
+		Kind:    RuntimeError,
+		Line:    2,
+		Column:  7,
+		Length:  7,
+		Token:   `a + "x"`,
+		Message: "Invalid operation. Mismatched types float and string",
+		Source:  `print a + "x";`,
+	}
+
+	for _, backend := range []Backend{TreeWalker, BytecodeVM} {
+		interpreter := NewInterpreter(ioutil.Discard)
+		interpreter.SetBackend(backend)
+
+		diags, err := interpreter.Exec(strings.NewReader(src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(diags) != 1 {
+			t.Fatalf("backend %d: got %d diagnostics, want 1", backend, len(diags))
+		}
+
+		got := diags[0]
+		got.Trace = nil
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("backend %d: got %+v, want %+v", backend, got, want)
+		}
+	}
+}
+
+// One program per runtime error the language can raise. Each is run on its own
+// since execution stops at the first runtime error.
+var runtimeErrorTests = []struct {
+	src string
+	vm  string // first line of the VM's output for errors only it raises
+}{
+	{src: `print -"a";`},
+	{src: `print 1 + "a";`},
+	{src: `print "a" - "b";`},
+	{src: `print nope;`},
+	{src: `nope = 1;`},
+	{src: `var a = 1; a();`},
+	{src: `fun f(x) {} f();`},
+	{src: `class C {} C(1);`},
+	{src: `class C { init(a) {} } C();`},
+	{src: `var x = 1; print x.y;`},
+	{src: `var x = 1; x.y = 2;`},
+	{src: `class C {} print C().missing;`},
+	{src: `var l = [1]; print l[5];`},
+	{src: `var l = [1]; print l["a"];`},
+	{src: `var l = [1]; l[3] = 1;`},
+	{src: `var m = {}; m[nil] = 1;`},
+	{src: `var m = {"a": 1}; print m[[1]];`},
+	{src: `print "abc"[9];`},
+	{src: `var n = 1; print n[0];`},
+	{src: `for (x in 5) print x;`},
+	{src: `print substr("abc", 2, 5);`},
+	{src: `print len(5);`},
+	{src: `push(1, 2);`},
+	{src: `var B = 1; class D < B {}`},
+	{src: `class A {} class B < A { m() { return super.nope(); } } B().m();`},
+	{src: `class A { m() { return 1 + nil; } } A().m();`},
+	{src: `fun g() { return h(); } fun h() { return [1][2]; } g();`},
+	{src: `print    (1 +    2) * "x";`},
+	{src: bigFrames(), vm: "[line 1] Stack overflow."},
+}
+
+// Recurses 250 calls deep through frames of 240 locals and a 31 item list,
+// more than fits on the VM's stack. The tree-walker has no such limit.
+func bigFrames() string {
+	var b strings.Builder
+	b.WriteString("fun f(n) {")
+	for i := 0; i < 240; i++ {
+		fmt.Fprintf(&b, " var a%d = %d;", i, i)
+	}
+	b.WriteString(" if (n == 0) return []; return [")
+	for i := 0; i < 30; i++ {
+		fmt.Fprintf(&b, "%d, ", i)
+	}
+	b.WriteString("f(n - 1)]; } print len(f(250));")
+	return b.String()
+}
+
+func TestBackendsAgreeOnErrors(t *testing.T) {
+	for _, tt := range runtimeErrorTests {
+		tree := runOn(TreeWalker, tt.src)
+		vm := runOn(BytecodeVM, tt.src)
+
+		if tt.vm != "" {
+			if got := strings.SplitN(vm, "\n", 2)[0]; got != tt.vm {
+				t.Errorf("got %q from the vm, want %q", got, tt.vm)
+			}
+			continue
+		}
+
+		if tree != vm {
+			t.Errorf("backends disagree\ntree-walker:\n%s\nvm:\n%s", tree, vm)
+		}
+	}
+}